@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access control rules are evaluated by the endpoint before it dials for a client, the first matching rule wins.
+// A rule looks like `allow peer=host-a network=tcp cidr=10.0.0.0/8 domain=corp.example.com port=443,8000-9000`.
+// Every field is optional and may have multiple values splitted by `,`, a rule matches if all its fields match.
+//
+//	peer:    the name in the client certificate, see getServerName.
+//	network: tcp, udp, bind, reverse or dns. Reverse rules are checked against the address the endpoint listens on,
+//	         dns rules are checked against the names in queries.
+//	cidr:    IP prefixes, or one of the aliases in `cidrAliases`. Checked against every resolved address.
+//	domain:  matches the domain and all its subdomains. Never matches requests for IP addresses.
+//	port:    ports or port ranges.
+//
+// Values of cidr and domain starting with `@` are read from the file after it, one value per line.
+
+var errAccessDenied = errors.New("destination is not allowed")
+
+var cidrAliases = map[string][]string{
+	"loopback":    {"127.0.0.0/8", "::1/128"},
+	"private":     {"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"},
+	"link-local":  {"169.254.0.0/16", "fe80::/10"},
+	"unspecified": {"0.0.0.0/32", "::/128"},
+}
+
+type portRange struct {
+	from, to uint16
+}
+
+type accessRule struct {
+	allow    bool
+	peers    []string
+	networks []string
+	prefixes []netip.Prefix
+	domains  []string
+	ports    []portRange
+}
+
+// accessControlList decides which destinations clients can reach through the endpoint.
+type accessControlList struct {
+	rules        []accessRule
+	defaultAllow bool
+}
+
+// normalizeNetwork maps the requested method to the network used by rules.
+func normalizeNetwork(network string) string {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return "tcp"
+	case strings.HasPrefix(network, "udp"):
+		return "udp"
+	}
+	return network
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+}
+
+func parsePortRange(value string) (portRange, error) {
+	from, to, isRange := strings.Cut(value, "-")
+	if !isRange {
+		to = from
+	}
+	fromPort, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port `%s`", value)
+	}
+	toPort, err := strconv.ParseUint(to, 10, 16)
+	if err != nil || toPort < fromPort {
+		return portRange{}, fmt.Errorf("invalid port `%s`", value)
+	}
+	return portRange{from: uint16(fromPort), to: uint16(toPort)}, nil
+}
+
+// readRuleLines calls `parse` on every line of `reader`. Empty lines and lines starting with `#` are ignored.
+func readRuleLines(reader io.Reader, parse func(line string) error) error {
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// readValueList reads the values of a field from the file `filePath`.
+func readValueList(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	values := []string{}
+	err = readRuleLines(file, func(line string) error {
+		values = append(values, line)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filePath, err)
+	}
+	return values, nil
+}
+
+func parseAccessRule(line string) (accessRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return accessRule{}, fmt.Errorf("empty rule")
+	}
+	if fields[0] != "allow" && fields[0] != "deny" {
+		return accessRule{}, fmt.Errorf("unknown action `%s`, expect allow or deny", fields[0])
+	}
+	rule, err := parseRuleFields(fields[1:])
+	if err != nil {
+		return accessRule{}, err
+	}
+	rule.allow = fields[0] == "allow"
+	return rule, nil
+}
+
+// parseRuleFields parses the `key=value` fields of a rule.
+func parseRuleFields(fields []string) (accessRule, error) {
+	rule := accessRule{}
+	for _, field := range fields {
+		key, rawValues, found := strings.Cut(field, "=")
+		if !found || len(rawValues) == 0 {
+			return accessRule{}, fmt.Errorf("invalid field `%s`, expect key=value", field)
+		}
+		values := []string{}
+		for _, value := range strings.Split(rawValues, ",") {
+			if (key == "cidr" || key == "domain") && strings.HasPrefix(value, "@") {
+				listedValues, err := readValueList(value[1:])
+				if err != nil {
+					return accessRule{}, err
+				}
+				values = append(values, listedValues...)
+				continue
+			}
+			values = append(values, value)
+		}
+		for _, value := range values {
+			switch key {
+			case "peer":
+				rule.peers = append(rule.peers, value)
+			case "network":
+				if value != "tcp" && value != "udp" && value != "bind" && value != "reverse" && value != "dns" {
+					return accessRule{}, fmt.Errorf("unknown network `%s`", value)
+				}
+				rule.networks = append(rule.networks, value)
+			case "cidr":
+				prefixes, exist := cidrAliases[value]
+				if !exist {
+					prefixes = []string{value}
+				}
+				for _, rawPrefix := range prefixes {
+					prefix, err := netip.ParsePrefix(rawPrefix)
+					if err != nil {
+						return accessRule{}, err
+					}
+					rule.prefixes = append(rule.prefixes, prefix.Masked())
+				}
+			case "domain":
+				rule.domains = append(rule.domains, normalizeDomain(value))
+			case "port":
+				ports, err := parsePortRange(value)
+				if err != nil {
+					return accessRule{}, err
+				}
+				rule.ports = append(rule.ports, ports)
+			default:
+				return accessRule{}, fmt.Errorf("unknown field `%s`", key)
+			}
+		}
+	}
+	return rule, nil
+}
+
+func (rule *accessRule) match(peer, network, domain string, ip netip.Addr, port uint16) bool {
+	if len(rule.peers) > 0 {
+		matched := false
+		for _, expected := range rule.peers {
+			matched = matched || expected == peer
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.networks) > 0 {
+		matched := false
+		for _, expected := range rule.networks {
+			matched = matched || expected == network
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.ports) > 0 {
+		matched := false
+		for _, ports := range rule.ports {
+			matched = matched || (ports.from <= port && port <= ports.to)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.domains) > 0 {
+		matched := false
+		for _, suffix := range rule.domains {
+			matched = matched || (len(domain) > 0 && (domain == suffix || strings.HasSuffix(domain, "."+suffix)))
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(rule.prefixes) > 0 {
+		matched := false
+		for _, prefix := range rule.prefixes {
+			matched = matched || prefix.Contains(ip.Unmap())
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Allowed returns true if the first rule matching the destination allows it.
+// `peer` is the name of the client, `domain` is empty if the client requested an IP address.
+func (acl *accessControlList) Allowed(peer, network, domain string, ip netip.Addr, port uint16) bool {
+	if acl == nil {
+		return true
+	}
+	network, domain = normalizeNetwork(network), normalizeDomain(domain)
+	for _, rule := range acl.rules {
+		if rule.match(peer, network, domain, ip, port) {
+			return rule.allow
+		}
+	}
+	return acl.defaultAllow
+}
+
+// Resolve resolves `address` with endpointDNS and returns the resolved addresses the list allows, in the resolver's order.
+// Dialing the returned addresses instead of `address` keeps the check valid if DNS answers change.
+// A nil list allows every address.
+func (acl *accessControlList) Resolve(ctx context.Context, peer, network, address string) ([]string, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, normalizeNetwork(network), rawPort)
+	if err != nil {
+		return nil, err
+	}
+	domain := host
+	if _, err := netip.ParseAddr(host); err == nil {
+		domain = ""
+	}
+	ips, err := endpointDNS.LookupNetIP(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	allowed := []string{}
+	for _, ip := range ips {
+		// Methods like tcp4 and udp6 only reach addresses of their families.
+		if (strings.HasSuffix(network, "4") && !ip.Unmap().Is4()) || (strings.HasSuffix(network, "6") && !ip.Unmap().Is6()) {
+			continue
+		}
+		if acl.Allowed(peer, network, domain, ip, uint16(port)) {
+			allowed = append(allowed, net.JoinHostPort(ip.Unmap().String(), strconv.Itoa(port)))
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("%w: %s %s for `%s`", errAccessDenied, network, address, peer)
+	}
+	return allowed, nil
+}
+
+// LoadRules appends the rules read from `reader`, one per line. Empty lines and lines starting with `#` are ignored.
+func (acl *accessControlList) LoadRules(reader io.Reader) error {
+	return readRuleLines(reader, func(line string) error {
+		rule, err := parseAccessRule(line)
+		if err != nil {
+			return err
+		}
+		acl.rules = append(acl.rules, rule)
+		return nil
+	})
+}
+
+// loadAccessControlList builds the list from inline rules splitted by `;` and the rule file.
+// Returns nil if no rule is configured, which allows every destination.
+func loadAccessControlList(inlineRules, filePath, defaultAction string) (*accessControlList, error) {
+	acl := &accessControlList{}
+	switch defaultAction {
+	case "allow":
+		acl.defaultAllow = true
+	case "deny":
+		acl.defaultAllow = false
+	default:
+		return nil, fmt.Errorf("unknown default action `%s`, expect allow or deny", defaultAction)
+	}
+	if len(filePath) > 0 {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := acl.LoadRules(file); err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	if err := acl.LoadRules(strings.NewReader(strings.ReplaceAll(inlineRules, ";", "\n"))); err != nil {
+		return nil, fmt.Errorf("inline rules: %v", err)
+	}
+	if len(acl.rules) == 0 && acl.defaultAllow {
+		return nil, nil
+	}
+	return acl, nil
+}
+
+// dialRemote dials `address` on behalf of the client `peer`, only reaching the destinations allowed by `acl`.
+func dialRemote(acl *accessControlList, peer, network, address string) (net.Conn, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), *socks5DialTimeout)
+	defer cancelFn()
+	addresses, err := acl.Resolve(ctx, peer, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return endpointDNS.Dial(ctx, network, addresses)
+}
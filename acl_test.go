@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func TestAccessControlList(t *testing.T) {
+	acl, err := loadAccessControlList("deny cidr=loopback,link-local; allow network=tcp domain=example.com port=443,8000-9000; deny domain=example.com; allow cidr=10.0.0.0/8 network=udp", "", "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		network string
+		domain  string
+		ip      string
+		port    uint16
+		allowed bool
+	}{
+		{"tcp", "", "127.0.0.1", 80, false},
+		{"tcp", "", "::ffff:169.254.169.254", 80, false},
+		{"tcp", "www.example.com", "1.2.3.4", 443, true},
+		{"tcp4", "EXAMPLE.COM.", "1.2.3.4", 8080, true},
+		{"tcp", "example.com", "1.2.3.4", 22, false},
+		{"udp", "www.example.com", "1.2.3.4", 443, false},
+		{"tcp", "badexample.com", "1.2.3.4", 443, false},
+		{"udp", "", "10.1.2.3", 53, true},
+		{"tcp", "", "10.1.2.3", 53, false},
+		{"tcp", "localhost", "127.0.0.1", 443, false},
+	}
+	for _, testCase := range testCases {
+		if allowed := acl.Allowed("", testCase.network, testCase.domain, netip.MustParseAddr(testCase.ip), testCase.port); allowed != testCase.allowed {
+			t.Errorf("%+v: got %v", testCase, allowed)
+		}
+	}
+
+	for _, rules := range []string{"permit", "allow cidr=1.2.3.4", "allow port=2-1", "allow network=icmp", "allow color=red"} {
+		if _, err := loadAccessControlList(rules, "", "allow"); err == nil {
+			t.Errorf("expect an error on `%s`", rules)
+		}
+	}
+	if acl, err := loadAccessControlList("", "", "allow"); acl != nil || err != nil {
+		t.Errorf("expect no list if nothing is configured, got %v %v", acl, err)
+	}
+}
+
+func TestEndpointAccessDenied(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	proxyAddress := startProxyServer(t)
+
+	acl, err := loadAccessControlList("deny cidr=loopback", "", "allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acl.Resolve(context.Background(), "", "tcp", echoAddress); !errors.Is(err, errAccessDenied) {
+		t.Errorf("expect errAccessDenied, got %v", err)
+	}
+
+	endpointACL = acl
+	defer func() { endpointACL = nil }()
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = proxyHandshake(conn, "tcp", echoAddress, false, false)
+	if code := socks5ReplyCode(err); code != socks5ReplyNotAllowed {
+		t.Errorf("expect not allowed, got %d (%v)", code, err)
+	}
+}
+
+func TestAccessControlListPeers(t *testing.T) {
+	acl, err := loadAccessControlList("allow peer=host-a cidr=10.0.0.0/8; allow peer=host-b port=443", "", "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		peer    string
+		ip      string
+		port    uint16
+		allowed bool
+	}{
+		{"host-a", "10.1.2.3", 22, true},
+		{"host-a", "1.2.3.4", 443, false},
+		{"host-b", "10.1.2.3", 22, false},
+		{"host-b", "1.2.3.4", 443, true},
+		{"host-c", "1.2.3.4", 443, false},
+		{"", "10.1.2.3", 22, false},
+	}
+	for _, testCase := range testCases {
+		if allowed := acl.Allowed(testCase.peer, "tcp", "", netip.MustParseAddr(testCase.ip), testCase.port); allowed != testCase.allowed {
+			t.Errorf("%+v: got %v", testCase, allowed)
+		}
+	}
+}
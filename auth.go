@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Socks5Credentials holds the username/password pairs accepted by a socks5 frontend.
+type Socks5Credentials struct {
+	users map[string]string
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// NewSocks5Credentials creates an empty credential store.
+func NewSocks5Credentials() *Socks5Credentials {
+	return &Socks5Credentials{
+		users: map[string]string{},
+		allow: map[string]bool{},
+		deny:  map[string]bool{},
+	}
+}
+
+// Empty returns true if no user is registered.
+func (creds *Socks5Credentials) Empty() bool {
+	return creds == nil || len(creds.users) == 0
+}
+
+// Add registers a user, an existing user will be overwritten.
+func (creds *Socks5Credentials) Add(username, password string) error {
+	if len(username) == 0 || len(username) > 255 {
+		return fmt.Errorf("invalid username length: %d", len(username))
+	}
+	if len(password) == 0 || len(password) > 255 {
+		return fmt.Errorf("invalid password length for user `%s`", username)
+	}
+	creds.users[username] = password
+	return nil
+}
+
+// AddList parses `user:password` pairs splitted by `,`.
+func (creds *Socks5Credentials) AddList(list string) error {
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		username, password, found := strings.Cut(pair, ":")
+		if !found {
+			return fmt.Errorf("invalid credential `%s`, expect user:password", username)
+		}
+		if err := creds.Add(username, password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Load reads `user:password` pairs from `reader`, one per line. Empty lines and lines starting with `#` are ignored.
+func (creds *Socks5Credentials) Load(reader io.Reader) error {
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, password, found := strings.Cut(line, ":")
+		if !found {
+			return fmt.Errorf("line %d: expect user:password", lineNumber)
+		}
+		if err := creds.Add(username, password); err != nil {
+			return fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// LoadFile reads credentials from the file at `path`.
+func (creds *Socks5Credentials) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return creds.Load(file)
+}
+
+// SetAllowList restricts the accepted users to `users`. An empty list allows every registered user.
+func (creds *Socks5Credentials) SetAllowList(users []string) {
+	creds.allow = map[string]bool{}
+	for _, user := range users {
+		if user = strings.TrimSpace(user); len(user) > 0 {
+			creds.allow[user] = true
+		}
+	}
+}
+
+// SetDenyList rejects `users` even if their password matches.
+func (creds *Socks5Credentials) SetDenyList(users []string) {
+	creds.deny = map[string]bool{}
+	for _, user := range users {
+		if user = strings.TrimSpace(user); len(user) > 0 {
+			creds.deny[user] = true
+		}
+	}
+}
+
+// Verify returns true if `username` is permitted and `password` matches.
+func (creds *Socks5Credentials) Verify(username, password string) bool {
+	if creds.Empty() {
+		return false
+	}
+	expected, exist := creds.users[username]
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(password)) != 1 || !exist {
+		return false
+	}
+	if creds.deny[username] {
+		return false
+	}
+	if len(creds.allow) > 0 && !creds.allow[username] {
+		return false
+	}
+	return true
+}
+
+// loadSocks5Credentials collects socks5 credentials from `CLOVER_SOCKS5_AUTH`, the credential file and the inline list.
+// Returns nil if no credential is configured, which means no authentication is required.
+func loadSocks5Credentials(inlineList, filePath, allowList, denyList string) (*Socks5Credentials, error) {
+	creds := NewSocks5Credentials()
+	if env := os.Getenv("CLOVER_SOCKS5_AUTH"); len(env) > 0 {
+		if err := creds.AddList(env); err != nil {
+			return nil, fmt.Errorf("`CLOVER_SOCKS5_AUTH`: %v", err)
+		}
+	}
+	if len(filePath) > 0 {
+		if err := creds.LoadFile(filePath); err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	if err := creds.AddList(inlineList); err != nil {
+		return nil, err
+	}
+	if len(allowList) > 0 {
+		creds.SetAllowList(strings.Split(allowList, ","))
+	}
+	if len(denyList) > 0 {
+		creds.SetDenyList(strings.Split(denyList, ","))
+	}
+	if creds.Empty() {
+		if len(allowList) > 0 || len(denyList) > 0 {
+			return nil, fmt.Errorf("socks5 user allow/deny list is set but no credential is provided")
+		}
+		return nil, nil
+	}
+	return creds, nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The `ca` subcommands manage a small CA issuing the identities of clover3 nodes:
+//
+//	clover3 ca init [-dir .] [-name clover3-ca] [-days 3650]
+//	clover3 ca issue [-dir .] [-out .] [-days 365] [-tokens] <name>
+//
+// `init` writes ca.crt and ca.key to `-dir`. `issue` signs a certificate for the channel `name` with the CA in `-dir`,
+// and writes <name>.crt and <name>.key to `-out`. With `-tokens`, `-out` is filled like the embedded tokens/ directory
+// instead: ca.crt, cert.crt and cert.key.
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+)
+
+// newSerialNumber returns a random serial number of 128 bits.
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// writePEMFile writes `data` as a PEM block of `blockType`, refusing to overwrite existing files.
+func writePEMFile(filePath, blockType string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if err := pem.Encode(file, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pemFile is a PEM block to be written by writePEMFiles.
+type pemFile struct {
+	path      string
+	blockType string
+	data      []byte
+	perm      os.FileMode
+}
+
+// writePEMFiles writes `files` as a whole, so that no partial identity is left behind: nothing is written if any
+// of them exists, and the files already written are removed if writing one fails.
+func writePEMFiles(files ...pemFile) error {
+	for _, file := range files {
+		if _, err := os.Lstat(file.path); err == nil {
+			return fmt.Errorf("%s already exists", file.path)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for i, file := range files {
+		if err := writePEMFile(file.path, file.blockType, file.data, file.perm); err != nil {
+			for _, written := range files[:i] {
+				os.Remove(written.path)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// keyPairFiles returns the files of the certificate `rawCert` and the private key `key` at `certPath` and `keyPath`.
+func keyPairFiles(certPath, keyPath string, rawCert []byte, key *ecdsa.PrivateKey) ([]pemFile, error) {
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return []pemFile{
+		{path: certPath, blockType: "CERTIFICATE", data: rawCert, perm: 0644},
+		{path: keyPath, blockType: "PRIVATE KEY", data: rawKey, perm: 0600},
+	}, nil
+}
+
+// initCA creates a CA named `commonName` valid for `validity`, and writes it to `dir`.
+func initCA(dir, commonName string, validity time.Duration) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	files, err := keyPairFiles(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile), rawCert, key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writePEMFiles(files...)
+}
+
+// loadCA reads the CA written by initCA from `dir`.
+func loadCA(dir string) (*x509.Certificate, []byte, interface{}, error) {
+	caPair, err := tls.LoadX509KeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cannot load the CA in `%s`: %v", dir, err)
+	}
+	caCert, err := x509.ParseCertificate(caPair.Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !caCert.IsCA {
+		return nil, nil, nil, fmt.Errorf("%s is not a CA certificate", filepath.Join(dir, caCertFile))
+	}
+	return caCert, caPair.Certificate[0], caPair.PrivateKey, nil
+}
+
+// validateNodeName checks that `name` can be the channel of a node. Channels of a node might be followed
+// by `@` and a suffix, see channelTLSConfig, and groups are splitted by `|`.
+func validateNodeName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("empty name")
+	}
+	if strings.ContainsAny(name, "@|,:;/\\ ") {
+		return fmt.Errorf("invalid name `%s`, names cannot contain any of `@|,:;/\\` or spaces", name)
+	}
+	return nil
+}
+
+// issueCertificate signs a certificate for the node `name` with the CA in `caDir`, valid for `validity`.
+// The name is the first DNS name of the certificate, as getServerName expects. Nodes serve and dial channels,
+// so the certificate is valid for both server and client authentication.
+// If `tokens` is true, `outDir` is written in the layout of the embedded tokens/ directory.
+func issueCertificate(caDir, name string, validity time.Duration, outDir string, tokens bool) error {
+	if err := validateNodeName(name); err != nil {
+		return err
+	}
+	caCert, rawCACert, caKey, err := loadCA(caDir)
+	if err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	notAfter := time.Now().Add(validity)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	var files []pemFile
+	if tokens {
+		files, err = keyPairFiles(filepath.Join(outDir, "cert.crt"), filepath.Join(outDir, "cert.key"), rawCert, key)
+		// `outDir` might be the CA directory itself, as both default to ".", its ca.crt is the token then.
+		caPath := filepath.Join(outDir, "ca.crt")
+		existing, readErr := os.ReadFile(caPath)
+		if readErr != nil || !bytes.Equal(existing, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rawCACert})) {
+			files = append(files, pemFile{path: caPath, blockType: "CERTIFICATE", data: rawCACert, perm: 0644})
+		}
+	} else {
+		files, err = keyPairFiles(filepath.Join(outDir, name+".crt"), filepath.Join(outDir, name+".key"), rawCert, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		return err
+	}
+	return writePEMFiles(files...)
+}
+
+var errCAUsage = errors.New("usage: clover3 ca init [flags] | clover3 ca issue [flags] <name>")
+
+// runCA runs the `ca` subcommand with `args` following it.
+func runCA(args []string) error {
+	if len(args) == 0 {
+		return errCAUsage
+	}
+	switch args[0] {
+	case "init":
+		flags := flag.NewFlagSet("ca init", flag.ContinueOnError)
+		dir := flags.String("dir", ".", "The directory to write ca.crt and ca.key to.")
+		name := flags.String("name", "clover3-ca", "The common name of the CA.")
+		days := flags.Int("days", 3650, "The number of days the CA is valid for.")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *days <= 0 {
+			return fmt.Errorf("invalid -days %d, expect a positive number", *days)
+		}
+		if err := initCA(*dir, *name, time.Duration(*days)*24*time.Hour); err != nil {
+			return err
+		}
+		fmt.Printf("CA written to %s and %s\n", filepath.Join(*dir, caCertFile), filepath.Join(*dir, caKeyFile))
+		return nil
+	case "issue":
+		flags := flag.NewFlagSet("ca issue", flag.ContinueOnError)
+		dir := flags.String("dir", ".", "The directory of ca.crt and ca.key.")
+		out := flags.String("out", ".", "The directory to write the certificate and the key to.")
+		days := flags.Int("days", 365, "The number of days the certificate is valid for, capped by the CA.")
+		tokens := flags.Bool("tokens", false, "If true, write ca.crt, cert.crt and cert.key to `out`, ready to be embedded as tokens/.")
+		if err := flags.Parse(args[1:]); err != nil {
+			return err
+		}
+		if flags.NArg() != 1 {
+			return errCAUsage
+		}
+		if *days <= 0 {
+			return fmt.Errorf("invalid -days %d, expect a positive number", *days)
+		}
+		if err := issueCertificate(*dir, flags.Arg(0), time.Duration(*days)*24*time.Hour, *out, *tokens); err != nil {
+			return err
+		}
+		fmt.Printf("Certificate of `%s` written to %s\n", flags.Arg(0), *out)
+		return nil
+	}
+	return errCAUsage
+}
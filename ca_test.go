@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIssueCertificate(t *testing.T) {
+	dir := t.TempDir()
+	if err := initCA(dir, "test-ca", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := initCA(dir, "test-ca", 24*time.Hour); err == nil {
+		t.Error("expect an error when the CA exists")
+	}
+	if err := issueCertificate(dir, "host-a", 365*24*time.Hour, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCertificate(dir, "host-a@suffix", time.Hour, dir, false); err == nil {
+		t.Error("expect an error on invalid names")
+	}
+
+	tlsConfig, _, err := getTLSConfigFromFiles(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "host-a.crt"), filepath.Join(dir, "host-a.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := getCertificateName(cert); name != "host-a" {
+		t.Errorf("unexpected certificate name: %s", name)
+	}
+	if cert.NotAfter.After(time.Now().Add(25 * time.Hour)) {
+		t.Errorf("expect the certificate not to outlive the CA, expires at %v", cert.NotAfter)
+	}
+	for _, usage := range []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth} {
+		if _, err := cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: "host-a", KeyUsages: []x509.ExtKeyUsage{usage}}); err != nil {
+			t.Errorf("usage %v: %v", usage, err)
+		}
+	}
+}
+
+func TestIssueTokens(t *testing.T) {
+	caDir, tokensDir := t.TempDir(), filepath.Join(t.TempDir(), "tokens")
+	if err := runCA([]string{"init", "-dir", caDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCA([]string{"issue", "-dir", caDir, "-out", tokensDir, "-tokens", "host-b"}); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, _, err := getTLSConfigFromFiles(filepath.Join(tokensDir, "ca.crt"), filepath.Join(tokensDir, "cert.crt"), filepath.Join(tokensDir, "cert.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runCA([]string{"issue", "-dir", caDir, "-out", caDir, "host-c"}); err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, _, err := getTLSConfigFromFiles(filepath.Join(caDir, "ca.crt"), filepath.Join(caDir, "host-c.crt"), filepath.Join(caDir, "host-c.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = "host-b"
+
+	// Nodes issued by the same CA authenticate each other.
+	serverRaw, clientRaw := net.Pipe()
+	serverConn, clientConn := tls.Server(serverRaw, serverConfig), tls.Client(clientRaw, clientConfig)
+	defer serverRaw.Close()
+	defer clientRaw.Close()
+	result := make(chan error, 1)
+	go func() { result <- serverConn.Handshake() }()
+	if err := clientConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal(err)
+	}
+	if name, err := peerIdentity(serverConn); err != nil || name != "host-c" {
+		t.Errorf("unexpected peer identity: %s, %v", name, err)
+	}
+	if err := runCA([]string{"issue", "-dir", caDir}); err == nil {
+		t.Error("expect an error without a name")
+	}
+	for _, args := range [][]string{{"init", "-dir", t.TempDir(), "-days", "0"}, {"issue", "-dir", caDir, "-out", t.TempDir(), "-days", "-1", "host-d"}} {
+		if err := runCA(args); err == nil {
+			t.Errorf("expect an error on %v", args)
+		}
+	}
+}
+
+func TestIssueTokensDefaultDirectories(t *testing.T) {
+	workDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(workDir)
+	// `-dir` and `-out` both default to the working directory, which already has ca.crt.
+	if err := runCA([]string{"init"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCA([]string{"issue", "-tokens", "node"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := getTLSConfigFromFiles("ca.crt", "cert.crt", "cert.key"); err != nil {
+		t.Errorf("expect the tokens to be usable, got %v", err)
+	}
+}
+
+func TestIssueKeepsExistingFiles(t *testing.T) {
+	caDir, tokensDir := t.TempDir(), t.TempDir()
+	if err := initCA(caDir, "test-ca", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// Only cert.key exists, none of the other tokens is written.
+	if err := os.WriteFile(filepath.Join(tokensDir, "cert.key"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := issueCertificate(caDir, "host-a", time.Hour, tokensDir, true); err == nil {
+		t.Error("expect an error if a token exists")
+	}
+	for _, name := range []string{"ca.crt", "cert.crt"} {
+		if _, err := os.Stat(filepath.Join(tokensDir, name)); !os.IsNotExist(err) {
+			t.Errorf("expect %s not to be written, got %v", name, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(tokensDir, "cert.key")); err != nil || string(data) != "key" {
+		t.Errorf("expect the existing key to be kept, got %q (%v)", data, err)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"embed"
+	"encoding/pem"
 	"fmt"
+	"net"
 	"os"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -18,33 +22,80 @@ func getServerName(rawCert []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	return getCertificateName(cert), nil
+}
+
+// getCertificateName returns the first DNS name of `cert`, or its common name if there is none.
+func getCertificateName(cert *x509.Certificate) string {
 	name := cert.Subject.CommonName
 	if len(cert.DNSNames) > 0 {
 		name = cert.DNSNames[0]
 	}
-	return name, nil
+	return name
+}
+
+// peerIdentity returns the certificate name of the peer on `conn`, completing the TLS handshake if needed.
+// The handshake fails if it takes longer than -socks5-dial-timeout. Connections without TLS are anonymous and have
+// an empty identity.
+func peerIdentity(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(*socks5DialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	peerCertificates := tlsConn.ConnectionState().PeerCertificates
+	if len(peerCertificates) == 0 {
+		return "", fmt.Errorf("no peer certificate")
+	}
+	return getCertificateName(peerCertificates[0]), nil
+}
+
+// parseCAPEM returns the CA certificates in `caPEM` and a pool of them.
+func parseCAPEM(caPEM []byte) ([]*x509.Certificate, *x509.CertPool, error) {
+	var caCerts []*x509.Certificate
+	caPool := x509.NewCertPool()
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		caCerts = append(caCerts, cert)
+		caPool.AddCert(cert)
+	}
+	if len(caCerts) == 0 {
+		return nil, nil, fmt.Errorf("invalid CA format")
+	}
+	return caCerts, caPool, nil
 }
 
-func getTLSConfigFromEmbeded() (*tls.Config, error) {
+// getTLSConfigFromEmbeded returns the config of the embedded tokens, and the CA certificates it trusts.
+func getTLSConfigFromEmbeded() (*tls.Config, []*x509.Certificate, error) {
 	caPEM, err := embeddedFile.ReadFile("tokens/ca.crt")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read embedded ca.crt: %v", err)
+		return nil, nil, fmt.Errorf("failed to read embedded ca.crt: %v", err)
 	}
-	caPool := x509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(caPEM) {
-		return nil, fmt.Errorf("invalid CA format")
+	caCerts, caPool, err := parseCAPEM(caPEM)
+	if err != nil {
+		return nil, nil, err
 	}
 	crtPEM, err := embeddedFile.ReadFile("tokens/cert.crt")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read embedded cert.crt: %v", err)
+		return nil, nil, fmt.Errorf("failed to read embedded cert.crt: %v", err)
 	}
 	keyPEM, err := embeddedFile.ReadFile("tokens/cert.key")
 	if err != nil {
-		return nil, fmt.Errorf("failed to read embedded cert.key: %v", err)
+		return nil, nil, fmt.Errorf("failed to read embedded cert.key: %v", err)
 	}
 	cert, err := tls.X509KeyPair(crtPEM, keyPEM)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse certificate: %v", err)
+		return nil, nil, fmt.Errorf("failed to parse certificate: %v", err)
 	}
 	return &tls.Config{
 		RootCAs:      caPool,
@@ -53,30 +104,34 @@ func getTLSConfigFromEmbeded() (*tls.Config, error) {
 		Certificates: []tls.Certificate{cert},
 		NextProtos:   []string{"clover3"},
 		MinVersion:   tls.VersionTLS13,
-	}, nil
+	}, caCerts, nil
 }
 
-func getTLSConfigFromEnv() (*tls.Config, error) {
+func getTLSConfigFromEnv() (*tls.Config, []*x509.Certificate, error) {
 	if len(os.Getenv("CLOVER_CA")) == 0 {
-		return nil, fmt.Errorf("`CLOVER_CA` is undefined")
+		return nil, nil, fmt.Errorf("`CLOVER_CA` is undefined")
 	}
 	if len(os.Getenv("CLOVER_CRT")) == 0 {
-		return nil, fmt.Errorf("`CLOVER_CRT` is undefined")
+		return nil, nil, fmt.Errorf("`CLOVER_CRT` is undefined")
 	}
 	if len(os.Getenv("CLOVER_KEY")) == 0 {
-		return nil, fmt.Errorf("`CLOVER_KEY` is undefined")
+		return nil, nil, fmt.Errorf("`CLOVER_KEY` is undefined")
 	}
-	caPEM, err := os.ReadFile(os.Getenv("CLOVER_CA"))
+	return getTLSConfigFromFiles(os.Getenv("CLOVER_CA"), os.Getenv("CLOVER_CRT"), os.Getenv("CLOVER_KEY"))
+}
+
+func getTLSConfigFromFiles(caFile, certFile, keyFile string) (*tls.Config, []*x509.Certificate, error) {
+	caPEM, err := os.ReadFile(caFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	caPool := x509.NewCertPool()
-	if !caPool.AppendCertsFromPEM(caPEM) {
-		return nil, fmt.Errorf("invalid CA format")
+	caCerts, caPool, err := parseCAPEM(caPEM)
+	if err != nil {
+		return nil, nil, err
 	}
-	cert, err := tls.LoadX509KeyPair(os.Getenv("CLOVER_CRT"), os.Getenv("CLOVER_KEY"))
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	return &tls.Config{
 		RootCAs:      caPool,
@@ -85,5 +140,65 @@ func getTLSConfigFromEnv() (*tls.Config, error) {
 		Certificates: []tls.Certificate{cert},
 		NextProtos:   []string{"clover3"},
 		MinVersion:   tls.VersionTLS13,
-	}, nil
+	}, caCerts, nil
+}
+
+// loadTLSConfig loads the TLS material from the files if any is given, otherwise from `CLOVER_*` or the embedded tokens.
+// Peers in the revocation list at `revocationFile` are rejected if it is not empty, its CRLs must be issued by the CA.
+func loadTLSConfig(caFile, certFile, keyFile, revocationFile string) (*tls.Config, error) {
+	tlsConfig, caCerts, err := loadTLSMaterial(caFile, certFile, keyFile)
+	if err != nil || len(revocationFile) == 0 {
+		return tlsConfig, err
+	}
+	revocations, err := loadRevocationList(revocationFile, caCerts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load the revocation list: %v", err)
+	}
+	tlsConfig.VerifyConnection = revocations.VerifyConnection
+	return tlsConfig, nil
+}
+
+func loadTLSMaterial(caFile, certFile, keyFile string) (*tls.Config, []*x509.Certificate, error) {
+	if len(caFile) > 0 || len(certFile) > 0 || len(keyFile) > 0 {
+		tlsConfig, caCerts, err := getTLSConfigFromFiles(caFile, certFile, keyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot load TLS material: %v", err)
+		}
+		return tlsConfig, caCerts, nil
+	}
+	tlsConfig, caCerts, err := getTLSConfigFromEnv()
+	if err == nil {
+		return tlsConfig, caCerts, nil
+	}
+	tlsConfig, caCerts, err = getTLSConfigFromEmbeded()
+	if err == nil {
+		return tlsConfig, caCerts, nil
+	}
+	return nil, nil, fmt.Errorf("no available token, last error: %v", err)
+}
+
+// activeTLSConfig is the TLS config loaded last, replaced when certificates are reloaded.
+var activeTLSConfig atomic.Pointer[tls.Config]
+
+// reloadableTLSConfig returns a config handshaking with the certificate in activeTLSConfig at the time of each
+// handshake, so that reloads apply to new connections. Servers take the whole config from activeTLSConfig.
+// Clients keep the built-in verification with the CA pool of `tlsConfig`, which checks the server name or the IP
+// address dialed, and reject servers in the revocation list of activeTLSConfig. Dials needing a reloaded CA pool
+// use a clone of activeTLSConfig instead, see channelTLSConfig; relays are verified with the CA pool loaded at startup.
+func reloadableTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	reloadable := tlsConfig.Clone()
+	reloadable.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return activeTLSConfig.Load(), nil
+	}
+	reloadable.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &activeTLSConfig.Load().Certificates[0], nil
+	}
+	// Only clients handshake with this config, servers use the VerifyConnection of activeTLSConfig directly.
+	reloadable.VerifyConnection = func(state tls.ConnectionState) error {
+		if active := activeTLSConfig.Load(); active.VerifyConnection != nil {
+			return active.VerifyConnection(state)
+		}
+		return nil
+	}
+	return reloadable
 }
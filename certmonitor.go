@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"time"
+)
+
+// renewCommandTimeout is how long the renew command may run before it is killed.
+const renewCommandTimeout = 5 * time.Minute
+
+// certificateNotAfter returns the time the first certificate in the chain of `cert` expires.
+func certificateNotAfter(cert *tls.Certificate) (time.Time, error) {
+	if len(cert.Certificate) == 0 {
+		return time.Time{}, fmt.Errorf("empty certificate")
+	}
+	notAfter := time.Time{}
+	for _, rawCert := range cert.Certificate {
+		parsed, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if notAfter.IsZero() || parsed.NotAfter.Before(notAfter) {
+			notAfter = parsed.NotAfter
+		}
+	}
+	return notAfter, nil
+}
+
+// activeCertificateNotAfter returns the expiry of the certificate in activeTLSConfig.
+func activeCertificateNotAfter() (time.Time, error) {
+	tlsConfig := activeTLSConfig.Load()
+	if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+		return time.Time{}, fmt.Errorf("no certificate loaded")
+	}
+	return certificateNotAfter(&tlsConfig.Certificates[0])
+}
+
+// publishCertificateMetrics exports the remaining validity of the active certificate in /debug/vars of the pprof server.
+func publishCertificateMetrics() {
+	expvar.Publish("certificate_remaining_seconds", expvar.Func(func() interface{} {
+		notAfter, err := activeCertificateNotAfter()
+		if err != nil {
+			return nil
+		}
+		return time.Until(notAfter).Seconds()
+	}))
+}
+
+// runRenewCommand runs `command` with a shell, killing it after `timeout`. The command sees the expiry of the current
+// certificate in `CLOVER_CERT_NOT_AFTER` (RFC 3339), and should write the renewed files where TLS material is loaded from.
+func runRenewCommand(command string, notAfter time.Time, timeout time.Duration) error {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), timeout)
+	defer cancelFn()
+	cmd := exec.CommandContext(ctx, shell, flag, command)
+	cmd.Env = append(os.Environ(), "CLOVER_CERT_NOT_AFTER="+notAfter.Format(time.RFC3339))
+	// Children of the shell might keep the output open after it is killed.
+	cmd.WaitDelay = time.Second
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("renew command does not finish in %v: %s", timeout, output)
+		}
+		return fmt.Errorf("renew command failed: %v: %s", err, output)
+	}
+	return nil
+}
+
+// checkCertificate warns if the active certificate expires within `warnBefore`, and calls `renew` if so.
+// `renew` should make the renewed certificate active. Returns the remaining validity after renewing.
+func checkCertificate(warnBefore time.Duration, renew func(notAfter time.Time) error) (time.Duration, error) {
+	notAfter, err := activeCertificateNotAfter()
+	if err != nil {
+		return 0, err
+	}
+	remaining := time.Until(notAfter)
+	if remaining > warnBefore {
+		return remaining, nil
+	}
+	if remaining <= 0 {
+		log.Printf("ERROR: the certificate expired at %v, handshakes will fail", notAfter)
+	} else {
+		log.Printf("WARNING: the certificate expires in %v at %v", remaining.Round(time.Minute), notAfter)
+	}
+	if renew == nil {
+		return remaining, nil
+	}
+	if err := renew(notAfter); err != nil {
+		return remaining, err
+	}
+	if notAfter, err = activeCertificateNotAfter(); err != nil {
+		return 0, err
+	}
+	log.Printf("The active certificate expires at %v", notAfter)
+	return time.Until(notAfter), nil
+}
+
+// monitorCertificate calls checkCertificate now and every `interval` until `ctx` is done.
+// The certificate is only checked once if `interval` is not positive.
+func monitorCertificate(ctx context.Context, interval, warnBefore time.Duration, renew func(notAfter time.Time) error) {
+	if _, err := checkCertificate(warnBefore, renew); err != nil {
+		log.Printf("Certificate check failed: %v", err)
+	}
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := checkCertificate(warnBefore, renew); err != nil {
+			log.Printf("Certificate check failed: %v", err)
+		}
+	}
+}
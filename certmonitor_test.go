@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestCertificate returns a self-signed certificate named `name` expiring at `notAfter`.
+func newTestCertificate(t *testing.T, name string, notAfter time.Time) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{rawCert}, PrivateKey: key}
+}
+
+// setActiveCertificate makes `cert` active until the test ends.
+func setActiveCertificate(t *testing.T, cert tls.Certificate) {
+	saved := activeTLSConfig.Load()
+	t.Cleanup(func() { activeTLSConfig.Store(saved) })
+	activeTLSConfig.Store(&tls.Config{Certificates: []tls.Certificate{cert}})
+}
+
+func TestCheckCertificate(t *testing.T) {
+	setActiveCertificate(t, newTestCertificate(t, "host-a", time.Now().Add(30*24*time.Hour)))
+	renewed := 0
+	renew := func(notAfter time.Time) error {
+		renewed++
+		activeTLSConfig.Store(&tls.Config{Certificates: []tls.Certificate{newTestCertificate(t, "host-a", time.Now().Add(90*24*time.Hour))}})
+		return nil
+	}
+
+	remaining, err := checkCertificate(14*24*time.Hour, renew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed != 0 || remaining < 29*24*time.Hour {
+		t.Errorf("expect no renewal, got %d renewals and %v remaining", renewed, remaining)
+	}
+
+	remaining, err = checkCertificate(60*24*time.Hour, renew)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed != 1 || remaining < 89*24*time.Hour {
+		t.Errorf("expect the certificate to be renewed, got %d renewals and %v remaining", renewed, remaining)
+	}
+}
+
+func TestRunRenewCommand(t *testing.T) {
+	notAfter := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := runRenewCommand(`test "$CLOVER_CERT_NOT_AFTER" = 2030-01-02T03:04:05Z`, notAfter, time.Minute); err != nil {
+		t.Error(err)
+	}
+	if err := runRenewCommand("echo failure; exit 3", notAfter, time.Minute); err == nil {
+		t.Error("expect an error if the command fails")
+	}
+	start := time.Now()
+	if err := runRenewCommand("sleep 30", notAfter, 100*time.Millisecond); err == nil {
+		t.Error("expect an error if the command times out")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("expect the command to be killed, took %v", elapsed)
+	}
+}
+
+func TestMonitorCertificateOnce(t *testing.T) {
+	setActiveCertificate(t, newTestCertificate(t, "host-a", time.Now().Add(24*time.Hour)))
+	checked := 0
+	done := make(chan struct{})
+	go func() {
+		monitorCertificate(context.Background(), 0, 14*24*time.Hour, func(notAfter time.Time) error {
+			checked++
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect the monitor to return after one check if the interval is not positive")
+	}
+	if checked != 1 {
+		t.Errorf("expect one check, got %d", checked)
+	}
+}
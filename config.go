@@ -0,0 +1,433 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags are loaded from the sources below, a source overrides the ones before it:
+//
+//	1. tokens/cmdline.txt (one argument per line) and tokens/config.json embedded in the binary.
+//	2. The config file named by `-config`, or by `CLOVER_CONFIG` if the flag is not set.
+//	3. Environment variables named after flags, like `CLOVER_BRIDGE_URL` for `-bridge-url`.
+//	4. Command arguments.
+//
+// Config files are JSON objects made of the sections in `configSchema`, for example:
+//
+//	{
+//	  "relays": {"urls": ["quic://relay.example.com:13300"]},
+//	  "tls": {"ca": "/etc/clover3/ca.crt", "cert": "/etc/clover3/cert.crt", "key": "/etc/clover3/cert.key"},
+//	  "socks5": {"listen": [{"channel": "home", "port": 1080}], "auth": ["alice:secret"]},
+//	  "flags": {"drain-timeout": "1m"}
+//	}
+//
+// The `flags` section sets any flag by name.
+
+type configKind int
+
+const (
+	configString configKind = iota
+	configBool
+	configInt
+	configDuration
+	// A list of strings joined by `Separator` into the flag value.
+	configList
+	// A list of `{"channel": ..., "port": ...}` joined as `channel:port` pairs splitted by `,`.
+	configServices
+)
+
+// configField maps a key of a config section to a flag.
+type configField struct {
+	Flag      string
+	Kind      configKind
+	Separator string
+	// Validate checks the value, or every item of a list.
+	Validate func(value string) error
+}
+
+func validateOneOf(choices ...string) func(string) error {
+	return func(value string) error {
+		for _, choice := range choices {
+			if value == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("unknown value `%s`, expect one of %s", value, strings.Join(choices, ", "))
+	}
+}
+
+func validateRelayURL(value string) error {
+	relayURL, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if len(relayURL.Scheme) == 0 || len(relayURL.Host) == 0 {
+		return fmt.Errorf("invalid relay URL `%s`", value)
+	}
+	return nil
+}
+
+var configSchema = map[string]map[string]configField{
+	"relays": {
+		"urls":  {Flag: "bridge-url", Kind: configList, Separator: ",", Validate: validateRelayURL},
+		"serve": {Flag: "serve-bridge", Kind: configBool},
+	},
+	"tls": {
+		"ca":              {Flag: "tls-ca", Kind: configString},
+		"cert":            {Flag: "tls-cert", Kind: configString},
+		"key":             {Flag: "tls-key", Kind: configString},
+		"revocation_list": {Flag: "revocation-list", Kind: configString},
+	},
+	"endpoint": {
+		"channel":     {Flag: "endpoint-channel", Kind: configString},
+		"direct_port": {Flag: "endpoint-channel-direct-port", Kind: configInt},
+		"acl": {Flag: "endpoint-acl", Kind: configList, Separator: ";", Validate: func(value string) error {
+			_, err := parseAccessRule(value)
+			return err
+		}},
+		"acl_file":    {Flag: "endpoint-acl-file", Kind: configString},
+		"acl_default": {Flag: "endpoint-acl-default", Kind: configString, Validate: validateOneOf("allow", "deny")},
+		"dns_servers": {Flag: "endpoint-dns-servers", Kind: configList, Separator: ",", Validate: func(value string) error {
+			_, err := parseNameServers(value)
+			return err
+		}},
+		"dns_tcp": {Flag: "endpoint-dns-tcp", Kind: configBool},
+		"hosts": {Flag: "endpoint-hosts", Kind: configList, Separator: ";", Validate: func(value string) error {
+			_, err := newEndpointResolver("", false, value, "", ipFamilyAny, 0)
+			return err
+		}},
+		"hosts_file":           {Flag: "endpoint-hosts-file", Kind: configString},
+		"ip_family":            {Flag: "endpoint-ip-family", Kind: configString, Validate: validateOneOf(ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6)},
+		"happy_eyeballs_delay": {Flag: "endpoint-happy-eyeballs-delay", Kind: configDuration},
+		"reverse":              {Flag: "endpoint-reverse", Kind: configBool},
+		"reverse_public":       {Flag: "endpoint-reverse-public", Kind: configBool},
+	},
+	"socks5": {
+		"listen": {Flag: "socks5-list", Kind: configServices},
+		"public": {Flag: "socks5-public", Kind: configBool},
+		"auth": {Flag: "socks5-auth", Kind: configList, Separator: ",", Validate: func(value string) error {
+			return NewSocks5Credentials().AddList(value)
+		}},
+		"auth_file":          {Flag: "socks5-auth-file", Kind: configString},
+		"allow_users":        {Flag: "socks5-allow-users", Kind: configList, Separator: ","},
+		"deny_users":         {Flag: "socks5-deny-users", Kind: configList, Separator: ","},
+		"dial_timeout":       {Flag: "socks5-dial-timeout", Kind: configDuration},
+		"bind_timeout":       {Flag: "socks5-bind-timeout", Kind: configDuration},
+		"optimistic_connect": {Flag: "socks5-optimistic-connect", Kind: configBool},
+	},
+	"http_proxy": {
+		"listen": {Flag: "http-proxy-list", Kind: configServices},
+	},
+	"dns": {
+		"listen": {Flag: "dns-list", Kind: configServices},
+	},
+	"transparent": {
+		"listen": {Flag: "transparent-list", Kind: configServices},
+		"mode":   {Flag: "transparent-mode", Kind: configString, Validate: validateOneOf("redirect", "tproxy")},
+	},
+	"forward": {
+		"rules": {Flag: "forward", Kind: configList, Separator: ",", Validate: func(value string) error {
+			_, err := parseForwardRule(value)
+			return err
+		}},
+		"udp_timeout": {Flag: "forward-udp-timeout", Kind: configDuration},
+	},
+	"reverse_forward": {
+		"rules": {Flag: "reverse-forward", Kind: configList, Separator: ",", Validate: func(value string) error {
+			_, err := parseReverseForwardRules(value)
+			return err
+		}},
+	},
+	"routing": {
+		"rules": {Flag: "route", Kind: configList, Separator: ";", Validate: func(value string) error {
+			_, err := parseRouteRule(value)
+			return err
+		}},
+		"file":            {Flag: "route-file", Kind: configString},
+		"channels":        {Flag: "route-channels", Kind: configList, Separator: ","},
+		"group_policy":    {Flag: "channel-group-policy", Kind: configString, Validate: validateOneOf(groupPolicyFailover, groupPolicyRoundRobin, groupPolicyLeastLatency)},
+		"health_interval": {Flag: "channel-health-interval", Kind: configDuration},
+	},
+}
+
+// sortedKeys returns the keys of `object` in order, so that errors are reported deterministically.
+func sortedKeys(object map[string]json.RawMessage) []string {
+	keys := []string{}
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// decodeServices decodes a list of `{"channel": ..., "port": ...}` objects, see decodeConfigValue for errors.
+func decodeServices(raw json.RawMessage) (string, error) {
+	services := []map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &services); err != nil {
+		return "", fmt.Errorf(": expect a list of objects with channel and port")
+	}
+	pairs := []string{}
+	for i, service := range services {
+		var channel string
+		var port int
+		for _, key := range sortedKeys(service) {
+			switch key {
+			case "channel":
+				if err := json.Unmarshal(service[key], &channel); err != nil || len(channel) == 0 {
+					return "", fmt.Errorf("[%d].channel: expect a non-empty string", i)
+				}
+			case "port":
+				if err := json.Unmarshal(service[key], &port); err != nil || port <= 0 || port > 0xffff {
+					return "", fmt.Errorf("[%d].port: expect an integer between 1 and 65535", i)
+				}
+			default:
+				return "", fmt.Errorf("[%d].%s: unknown key", i, key)
+			}
+		}
+		if len(channel) == 0 || port == 0 {
+			return "", fmt.Errorf("[%d]: both channel and port are required", i)
+		}
+		pairs = append(pairs, fmt.Sprintf("%s:%d", channel, port))
+	}
+	return strings.Join(pairs, ","), nil
+}
+
+// decodeConfigValue converts `raw` to the value of the flag of `field`.
+// Errors start with the suffix of the path to the offending value, if any.
+func decodeConfigValue(field configField, raw json.RawMessage) (string, error) {
+	switch field.Kind {
+	case configBool:
+		var value bool
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf(": expect a boolean")
+		}
+		return strconv.FormatBool(value), nil
+	case configInt:
+		var value int
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return "", fmt.Errorf(": expect an integer")
+		}
+		return strconv.Itoa(value), nil
+	case configList:
+		values := []string{}
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return "", fmt.Errorf(": expect a list of strings")
+		}
+		for i, value := range values {
+			if field.Validate == nil {
+				continue
+			}
+			if err := field.Validate(value); err != nil {
+				return "", fmt.Errorf("[%d]: %v", i, err)
+			}
+		}
+		return strings.Join(values, field.Separator), nil
+	case configServices:
+		return decodeServices(raw)
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return "", fmt.Errorf(": expect a string")
+	}
+	if field.Kind == configDuration {
+		if _, err := time.ParseDuration(value); err != nil {
+			return "", fmt.Errorf(": invalid duration `%s`", value)
+		}
+	}
+	if field.Validate != nil {
+		if err := field.Validate(value); err != nil {
+			return "", fmt.Errorf(": %v", err)
+		}
+	}
+	return value, nil
+}
+
+// syntaxErrorLine returns the line of `offset` in `data`.
+func syntaxErrorLine(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + strings.Count(string(data[:offset]), "\n")
+}
+
+// parseConfig validates the JSON config in `data` and returns the flag values it sets.
+// Errors name the key of the offending value, like `socks5.listen[1].port`.
+// Keys of the `flags` section are checked against `flags`.
+func parseConfig(flags *flag.FlagSet, data []byte) (map[string]string, error) {
+	sections := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &sections); err != nil {
+		var syntaxError *json.SyntaxError
+		if errors.As(err, &syntaxError) {
+			return nil, fmt.Errorf("line %d: %v", syntaxErrorLine(data, syntaxError.Offset), err)
+		}
+		return nil, fmt.Errorf("expect a JSON object")
+	}
+	values := map[string]string{}
+	for _, sectionName := range sortedKeys(sections) {
+		if sectionName == "flags" {
+			if err := parseFlagsSection(flags, sections[sectionName], values); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		schema, exist := configSchema[sectionName]
+		if !exist {
+			return nil, fmt.Errorf("%s: unknown key", sectionName)
+		}
+		section := map[string]json.RawMessage{}
+		if err := json.Unmarshal(sections[sectionName], &section); err != nil {
+			return nil, fmt.Errorf("%s: expect an object", sectionName)
+		}
+		if sectionName == "tls" {
+			_, hasCA := section["ca"]
+			_, hasCert := section["cert"]
+			_, hasKey := section["key"]
+			if (hasCA || hasCert || hasKey) && !(hasCA && hasCert && hasKey) {
+				return nil, fmt.Errorf("tls: ca, cert and key are all required")
+			}
+		}
+		for _, key := range sortedKeys(section) {
+			field, exist := schema[key]
+			if !exist {
+				return nil, fmt.Errorf("%s.%s: unknown key", sectionName, key)
+			}
+			value, err := decodeConfigValue(field, section[key])
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s%v", sectionName, key, err)
+			}
+			values[field.Flag] = value
+		}
+	}
+	return values, nil
+}
+
+// parseFlagsSection reads the `flags` section, which sets flags by name to strings, numbers or booleans.
+func parseFlagsSection(flags *flag.FlagSet, raw json.RawMessage, values map[string]string) error {
+	section := map[string]json.RawMessage{}
+	if err := json.Unmarshal(raw, &section); err != nil {
+		return fmt.Errorf("flags: expect an object")
+	}
+	for _, name := range sortedKeys(section) {
+		if flags.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("flags.%s: unknown flag", name)
+		}
+		var value interface{}
+		if err := json.Unmarshal(section[name], &value); err != nil {
+			return fmt.Errorf("flags.%s: %v", name, err)
+		}
+		switch value := value.(type) {
+		case string:
+			values[name] = value
+		case bool, float64:
+			values[name] = string(section[name])
+		default:
+			return fmt.Errorf("flags.%s: expect a string, number or boolean", name)
+		}
+	}
+	return nil
+}
+
+// applyConfig validates the JSON config in `data` and sets the flags in `flags`.
+func applyConfig(flags *flag.FlagSet, data []byte) error {
+	values, err := parseConfig(flags, data)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedFlagNames(values) {
+		if err := flags.Set(name, values[name]); err != nil {
+			return fmt.Errorf("flag `%s`: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func sortedFlagNames(values map[string]string) []string {
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// loadConfigFile applies the config file at `filePath` to `flags`.
+func loadConfigFile(flags *flag.FlagSet, filePath string) error {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".yaml", ".yml", ".toml":
+		return fmt.Errorf("%s: only JSON config files are supported", filePath)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(flags, data); err != nil {
+		return fmt.Errorf("%s: %v", filePath, err)
+	}
+	return nil
+}
+
+// envFlagName returns the environment variable of the flag `name`.
+func envFlagName(name string) string {
+	return "CLOVER_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnvFlags sets the flags in `flags` whose environment variables are defined.
+func applyEnvFlags(flags *flag.FlagSet, lookupEnv func(key string) (string, bool)) error {
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		// `CLOVER_SOCKS5_AUTH` is merged with the flag by loadSocks5Credentials instead of overriding it.
+		if err != nil || f.Name == "socks5-auth" || f.Name == "config" {
+			return
+		}
+		if value, exist := lookupEnv(envFlagName(f.Name)); exist {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("%s: %v", envFlagName(f.Name), setErr)
+			}
+		}
+	})
+	return err
+}
+
+// configFilePath returns the config file `flags` are loaded from, empty if there is none.
+func configFilePath(flags *flag.FlagSet) string {
+	if configPath := flags.Lookup("config").Value.String(); len(configPath) > 0 {
+		return configPath
+	}
+	return os.Getenv("CLOVER_CONFIG")
+}
+
+// loadFlags sets `flags` from all sources in the order described above.
+func loadFlags(flags *flag.FlagSet, args []string) error {
+	if data, err := embeddedFile.ReadFile("tokens/cmdline.txt"); err == nil {
+		if err := flags.Parse(strings.Split(string(data), "\n")); err != nil {
+			return fmt.Errorf("embedded cmdline.txt: %v", err)
+		}
+	}
+	if data, err := embeddedFile.ReadFile("tokens/config.json"); err == nil {
+		if err := applyConfig(flags, data); err != nil {
+			return fmt.Errorf("embedded config.json: %v", err)
+		}
+	}
+	// Command arguments are parsed twice, first to find the config file, then to override other sources.
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if configPath := configFilePath(flags); len(configPath) > 0 {
+		if err := loadConfigFile(flags, configPath); err != nil {
+			return err
+		}
+	}
+	if err := applyEnvFlags(flags, os.LookupEnv); err != nil {
+		return err
+	}
+	return flags.Parse(args)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigSchemaFlags(t *testing.T) {
+	for sectionName, schema := range configSchema {
+		for key, field := range schema {
+			if cmdFlags.Lookup(field.Flag) == nil {
+				t.Errorf("%s.%s refers to an unknown flag `%s`", sectionName, key, field.Flag)
+			}
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	flags := newFlagMirror(cmdFlags)
+	config := `{
+		"relays": {"urls": ["quic://a.example.com:13300", "tcp://b.example.com"], "serve": true},
+		"endpoint": {"channel": "home", "direct_port": 0, "acl": ["deny cidr=loopback", "allow port=443"]},
+		"socks5": {"listen": [{"channel": "home", "port": 1080}, {"channel": "a|b", "port": 1081}], "dial_timeout": "5s"},
+		"forward": {"rules": ["home:8080:10.0.0.1:80"]},
+		"flags": {"drain-timeout": "1m", "socks5-public": true}
+	}`
+	if err := applyConfig(flags, []byte(config)); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"bridge-url":                   "quic://a.example.com:13300,tcp://b.example.com",
+		"serve-bridge":                 "true",
+		"endpoint-channel":             "home",
+		"endpoint-channel-direct-port": "0",
+		"endpoint-acl":                 "deny cidr=loopback;allow port=443",
+		"socks5-list":                  "home:1080,a|b:1081",
+		"socks5-dial-timeout":          "5s",
+		"forward":                      "home:8080:10.0.0.1:80",
+		"drain-timeout":                "1m",
+		"socks5-public":                "true",
+	}
+	for name, value := range expected {
+		if actual := flags.Lookup(name).Value.String(); actual != value {
+			t.Errorf("flag %s: got `%s`, expect `%s`", name, actual, value)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	for config, expectedError := range map[string]string{
+		`{"relay": {}}`:                                         "relay: unknown key",
+		`{"relays": {"url": []}}`:                               "relays.url: unknown key",
+		`{"relays": {"urls": "quic://a"}}`:                      "relays.urls: expect a list of strings",
+		`{"relays": {"urls": ["a", "quic://b"]}}`:               "relays.urls[0]: invalid relay URL",
+		`{"endpoint": {"direct_port": "1"}}`:                    "endpoint.direct_port: expect an integer",
+		`{"endpoint": {"acl": ["allow port=1", "drop"]}}`:       "endpoint.acl[1]: unknown action",
+		`{"socks5": {"listen": [{"channel": "a", "port": 0}]}}`: "socks5.listen[0].port: expect an integer",
+		`{"socks5": {"listen": [{"channel": "a"}]}}`:            "socks5.listen[0]: both channel and port are required",
+		`{"socks5": {"dial_timeout": "soon"}}`:                  "socks5.dial_timeout: invalid duration",
+		`{"transparent": {"mode": "nat"}}`:                      "transparent.mode: unknown value",
+		`{"tls": {"ca": "ca.crt"}}`:                             "tls: ca, cert and key are all required",
+		`{"flags": {"no-such-flag": "1"}}`:                      "flags.no-such-flag: unknown flag",
+		"{\n\"relays\": {\n}\n,}":                               "line 4:",
+	} {
+		err := applyConfig(newFlagMirror(cmdFlags), []byte(config))
+		if err == nil || !strings.HasPrefix(err.Error(), expectedError) {
+			t.Errorf("config %s: got error `%v`, expect `%s`", config, err, expectedError)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "clover3.json")
+	if err := os.WriteFile(configPath, []byte(`{"dns": {"listen": [{"channel": "home", "port": 5353}]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	flags := newFlagMirror(cmdFlags)
+	if err := loadConfigFile(flags, configPath); err != nil {
+		t.Fatal(err)
+	}
+	if value := flags.Lookup("dns-list").Value.String(); value != "home:5353" {
+		t.Errorf("unexpected dns-list: %s", value)
+	}
+	if err := loadConfigFile(flags, filepath.Join(dir, "clover3.yaml")); err == nil {
+		t.Error("expect an error on YAML config files")
+	}
+}
+
+func TestApplyEnvFlags(t *testing.T) {
+	flags := newFlagMirror(cmdFlags)
+	env := map[string]string{
+		"CLOVER_BRIDGE_URL":          "quic://env.example.com",
+		"CLOVER_SOCKS5_DIAL_TIMEOUT": "3s",
+		"CLOVER_SOCKS5_AUTH":         "alice:secret",
+	}
+	if err := applyEnvFlags(flags, func(key string) (string, bool) {
+		value, exist := env[key]
+		return value, exist
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if value := flags.Lookup("bridge-url").Value.String(); value != "quic://env.example.com" {
+		t.Errorf("unexpected bridge-url: %s", value)
+	}
+	if value := flags.Lookup("socks5-dial-timeout").Value.String(); value != "3s" {
+		t.Errorf("unexpected socks5-dial-timeout: %s", value)
+	}
+	// Credentials in the environment are merged by loadSocks5Credentials instead.
+	if value := flags.Lookup("socks5-auth").Value.String(); len(value) > 0 {
+		t.Errorf("expect socks5-auth not to be set from the environment, got %s", value)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// maxDatagramSize is the largest payload a framed datagram can carry.
+const maxDatagramSize = 65535
+
+// datagramConn preserves datagram boundaries over a stream connection.
+// Each datagram is prefixed with its length in 2 bytes (big endian).
+type datagramConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+}
+
+func newDatagramConn(conn net.Conn) *datagramConn {
+	return &datagramConn{Conn: conn, reader: bufio.NewReaderSize(conn, maxDatagramSize+2)}
+}
+
+// Read reads exactly one datagram. Similar to UDP sockets, the datagram is truncated if `p` is too small.
+func (conn *datagramConn) Read(p []byte) (int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn.reader, header); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header))
+	if size <= len(p) {
+		return io.ReadFull(conn.reader, p[:size])
+	}
+	n, err := io.ReadFull(conn.reader, p)
+	if err != nil {
+		return n, err
+	}
+	_, err = conn.reader.Discard(size - n)
+	return n, err
+}
+
+// Write sends `p` as one datagram.
+func (conn *datagramConn) Write(p []byte) (int, error) {
+	if len(p) > maxDatagramSize {
+		return 0, fmt.Errorf("datagram too large: %d bytes", len(p))
+	}
+	frame := make([]byte, 2+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[2:], p)
+
+	conn.writeMu.Lock()
+	defer conn.writeMu.Unlock()
+	if _, err := conn.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// copyDatagrams forwards datagrams from `src` to `dst` one by one until an error occurs.
+func copyDatagrams(dst io.Writer, src io.Reader) error {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+}
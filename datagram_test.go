@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// Covers DNS queries, typical QUIC packets and the largest UDP payload.
+var testDatagramSizes = []int{0, 33, 512, 1200, 1252, 1350, 1472, 4096, 65507}
+
+func testDatagram(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i*7 + size)
+	}
+	return data
+}
+
+func TestDatagramConnPreservesBoundaries(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		sender := newDatagramConn(conn)
+		// Writes back to back so that the stream is likely to coalesce them.
+		for _, size := range testDatagramSizes {
+			if _, err := sender.Write(testDatagram(size)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	receiver := newDatagramConn(conn)
+	buf := make([]byte, maxDatagramSize)
+	for _, size := range testDatagramSizes {
+		n, err := receiver.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], testDatagram(size)) {
+			t.Errorf("datagram of size %d is corrupted, got %d bytes", size, n)
+		}
+	}
+	if _, err := newDatagramConn(conn).Write(make([]byte, maxDatagramSize+1)); err == nil {
+		t.Error("expect an error on oversized datagram")
+	}
+}
+
+func TestProxyServerFramedUDP(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echoConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go handleProxyServer(listener, nil, newConnectionTracker())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyConn, err := proxyHandshake(conn, "udp", echoConn.LocalAddr().String(), false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyConn.Close()
+	if _, ok := proxyConn.LocalAddr().(*net.UDPAddr); !ok {
+		t.Errorf("expect an UDP bound address, got %v", proxyConn.LocalAddr())
+	}
+
+	// Larger packets might be fragmented or dropped on loopback interfaces with small MTUs.
+	sizes := []int{}
+	for _, size := range testDatagramSizes {
+		if size > 0 && size <= 1472 {
+			sizes = append(sizes, size)
+		}
+	}
+	// Sends every packet before reading so that a stream transport would coalesce them.
+	for _, size := range sizes {
+		if _, err := proxyConn.Write(testDatagram(size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]byte, maxDatagramSize)
+	for _, size := range sizes {
+		proxyConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := proxyConn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], testDatagram(size)) {
+			t.Errorf("datagram of size %d is corrupted, got %d bytes", size, n)
+		}
+	}
+}
+
+func TestProxyServerUDPMux(t *testing.T) {
+	echoAddrs := []string{}
+	for i := 0; i < 2; i++ {
+		echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echoConn.Close()
+		echoAddrs = append(echoAddrs, echoConn.LocalAddr().String())
+		go func(echoConn *net.UDPConn) {
+			buf := make([]byte, maxDatagramSize)
+			for {
+				n, addr, err := echoConn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				echoConn.WriteToUDP(buf[:n], addr)
+			}
+		}(echoConn)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go handleProxyServer(listener, nil, newConnectionTracker())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := proxyHandshake(conn, "udp-mux", "0.0.0.0:0", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+
+	for i, echoAddr := range echoAddrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", echoAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := new(bytes.Buffer)
+		if err := writeIPAndPort(packet, udpAddr); err != nil {
+			t.Fatal(err)
+		}
+		header := packet.Len()
+		packet.Write(testDatagram(1200 + i))
+		if _, err := tunnel.Write(packet.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := make([]byte, maxDatagramSize)
+		tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := tunnel.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bytes.NewReader(buf[:n])
+		source, err := readProxyAddress(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if source != echoAddr {
+			t.Errorf("expect the reply from %s, got %s", echoAddr, source)
+		}
+		if n-reader.Len() != header || !bytes.Equal(buf[header:n], testDatagram(1200+i)) {
+			t.Errorf("reply from %s is corrupted", echoAddr)
+		}
+	}
+}
+
+func TestProxyServerUDPMuxOversizedDatagram(t *testing.T) {
+	// Only an IPv6 source has a header long enough to overflow the frame along with the largest datagram.
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer sender.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go handleProxyServer(listener, nil, newConnectionTracker())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := proxyHandshake(conn, "udp-mux", "0.0.0.0:0", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	endpointAddr := &net.UDPAddr{IP: net.IPv6loopback, Port: tunnel.LocalAddr().(*net.UDPAddr).Port}
+
+	if _, err := sender.WriteToUDP(make([]byte, 65527), endpointAddr); err != nil {
+		t.Skipf("cannot send the largest IPv6 datagram: %v", err)
+	}
+	if _, err := sender.WriteToUDP(testDatagram(1200), endpointAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	tunnel.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := tunnel.Read(buf)
+	if err != nil {
+		t.Fatalf("expect the association to survive the oversized datagram: %v", err)
+	}
+	reader := bytes.NewReader(buf[:n])
+	if _, err := readProxyAddress(reader); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[n-reader.Len():n], testDatagram(1200)) {
+		t.Errorf("expect the oversized datagram to be dropped, got %d bytes", reader.Len())
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// The local DNS service forwards queries to the endpoint by a `dns` request, so that names are resolved by the
+// endpoint's name servers. Queries and responses are exchanged as framed datagrams, many queries share a tunnel
+// and are told apart by their IDs. Responses are cached locally until their TTLs expire.
+
+const (
+	dnsQueryTimeout   = 5 * time.Second
+	dnsUDPTimeout     = 2 * time.Second
+	dnsHostsTTL       = 60
+	dnsMaxCacheSize   = 4096
+	dnsNegativeMaxTTL = 5 * time.Minute
+	// dnsMaxConcurrency bounds the queries resolved at the same time for a tunnel or a local DNS service.
+	dnsMaxConcurrency = 64
+)
+
+// systemNameServers returns the name servers in /etc/resolv.conf.
+func systemNameServers() []string {
+	servers := []string{}
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return []string{"127.0.0.1:53"}
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip, err := netip.ParseAddr(fields[1]); err == nil {
+				servers = append(servers, netip.AddrPortFrom(ip, 53).String())
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return []string{"127.0.0.1:53"}
+	}
+	return servers
+}
+
+var errDNSTruncated = errors.New("truncated dns response")
+
+// exchangeDNSOnce sends `query` to `server` over `network` and waits for the response.
+func exchangeDNSOnce(ctx context.Context, network string, query []byte, server string) ([]byte, error) {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if network == "udp" && (!ok || time.Until(deadline) > dnsUDPTimeout) {
+		deadline, ok = time.Now().Add(dnsUDPTimeout), true
+	}
+	if ok {
+		conn.SetDeadline(deadline)
+	}
+	var rawConn io.ReadWriter = conn
+	if network == "tcp" {
+		// DNS over TCP prefixes messages with their lengths, same as framed datagrams.
+		rawConn = newDatagramConn(conn)
+	}
+	if _, err := rawConn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := rawConn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		var parser dnsmessage.Parser
+		header, err := parser.Start(buf[:n])
+		// Ignores stray packets on UDP.
+		if err != nil || !header.Response || header.ID != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		if header.Truncated && network == "udp" {
+			return nil, errDNSTruncated
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeDNS sends `query` to `server` over UDP, and retries over TCP if the response is truncated or UDP fails.
+// Only TCP is used if `forceTCP` is true.
+func exchangeDNS(ctx context.Context, query []byte, server string, forceTCP bool) ([]byte, error) {
+	if !forceTCP {
+		answer, err := exchangeDNSOnce(ctx, "udp", query, server)
+		if err == nil || ctx.Err() != nil {
+			return answer, err
+		}
+	}
+	return exchangeDNSOnce(ctx, "tcp", query, server)
+}
+
+// dnsHostsResponse answers `query` with the static addresses `addrs` of the name in `question`.
+func dnsHostsResponse(query []byte, question dnsmessage.Question, addrs []netip.Addr) ([]byte, error) {
+	response := dnsmessage.Message{}
+	if err := response.Unpack(query); err != nil {
+		return nil, err
+	}
+	response.Response, response.RecursionAvailable, response.Authoritative = true, true, true
+	response.Questions = []dnsmessage.Question{question}
+	response.Answers, response.Authorities, response.Additionals = nil, nil, nil
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: dnsHostsTTL}
+	for _, addr := range addrs {
+		if question.Type == dnsmessage.TypeA && addr.Is4() {
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: addr.As4()}})
+		}
+		if question.Type == dnsmessage.TypeAAAA && addr.Is6() {
+			response.Answers = append(response.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return response.Pack()
+}
+
+// dnsFailureResponse builds an empty response to `query` with `rcode`.
+func dnsFailureResponse(query []byte, rcode dnsmessage.RCode) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	response := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 header.ID,
+			Response:           true,
+			OpCode:             header.OpCode,
+			RecursionDesired:   header.RecursionDesired,
+			RecursionAvailable: true,
+			RCode:              rcode,
+		},
+		Questions: questions,
+	}
+	return response.Pack()
+}
+
+// dnsFamilyExcludes returns true if the endpoint does not connect to the addresses queried by `qtype` with `family`.
+func dnsFamilyExcludes(family string, qtype dnsmessage.Type) bool {
+	return (family == ipFamilyIPv4 && qtype == dnsmessage.TypeAAAA) || (family == ipFamilyIPv6 && qtype == dnsmessage.TypeA)
+}
+
+// serveDNS answers the queries sent by `peer` with the static names and name servers of endpointDNS.
+// Queries of addresses out of the IP family of endpointDNS get empty answers.
+func serveDNS(clientconn net.Conn, peer string, reply func(response) error) {
+	servers := endpointDNS.NameServers()
+	if reply(response{Success: true, Payload: servers[0], Framed: true}) != nil {
+		return
+	}
+	datagramClientConn := newDatagramConn(clientconn)
+	// Reading stops while too many queries are being resolved, so that the client is slowed down instead.
+	slots := make(chan struct{}, dnsMaxConcurrency)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := datagramClientConn.Read(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte{}, buf[:n]...)
+		slots <- struct{}{}
+		go func() {
+			defer func() { <-slots }()
+			var parser dnsmessage.Parser
+			if _, err := parser.Start(query); err != nil {
+				return
+			}
+			question, err := parser.Question()
+			if err != nil {
+				return
+			}
+			answer := []byte(nil)
+			hosts := endpointDNS.Hosts(question.Name.String())
+			if !endpointACL.Allowed(peer, "dns", question.Name.String(), netip.Addr{}, 53) {
+				answer, err = dnsFailureResponse(query, dnsmessage.RCodeRefused)
+			} else if dnsFamilyExcludes(endpointDNS.family, question.Type) {
+				// Clients would be given addresses the endpoint refuses to connect to.
+				answer, err = dnsFailureResponse(query, dnsmessage.RCodeSuccess)
+			} else if len(hosts) > 0 && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA) {
+				answer, err = dnsHostsResponse(query, question, hosts)
+			} else {
+				for _, server := range servers {
+					ctx, cancelFn := context.WithTimeout(context.Background(), dnsQueryTimeout)
+					answer, err = exchangeDNS(ctx, query, server, endpointDNS.forceTCP)
+					cancelFn()
+					if err == nil {
+						break
+					}
+				}
+				if err != nil {
+					log.Printf("[%s] dns %s failed: %v", peer, question.Name.String(), err)
+					answer, err = dnsFailureResponse(query, dnsmessage.RCodeServerFailure)
+				}
+			}
+			if err == nil {
+				datagramClientConn.Write(answer)
+			}
+		}()
+	}
+}
+
+type dnsCacheEntry struct {
+	message dnsmessage.Message
+	stored  time.Time
+	expire  time.Time
+}
+
+// dnsCache keeps responses keyed by their questions until their TTLs expire.
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[dnsmessage.Question]*dnsCacheEntry
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{entries: map[dnsmessage.Question]*dnsCacheEntry{}}
+}
+
+// cacheTTL returns how long `message` can be cached, false if it should not be cached.
+func cacheTTL(message *dnsmessage.Message) (time.Duration, bool) {
+	if message.Truncated || (message.RCode != dnsmessage.RCodeSuccess && message.RCode != dnsmessage.RCodeNameError) {
+		return 0, false
+	}
+	if len(message.Answers) > 0 {
+		ttl := message.Answers[0].Header.TTL
+		for _, resource := range message.Answers {
+			if resource.Header.TTL < ttl {
+				ttl = resource.Header.TTL
+			}
+		}
+		return time.Duration(ttl) * time.Second, ttl > 0
+	}
+	// Negative answers are cached by the SOA record in the authority section, see RFC 2308.
+	for _, resource := range message.Authorities {
+		if soa, ok := resource.Body.(*dnsmessage.SOAResource); ok {
+			ttl := time.Duration(resource.Header.TTL) * time.Second
+			if minTTL := time.Duration(soa.MinTTL) * time.Second; minTTL < ttl {
+				ttl = minTTL
+			}
+			if ttl > dnsNegativeMaxTTL {
+				ttl = dnsNegativeMaxTTL
+			}
+			return ttl, ttl > 0
+		}
+	}
+	return 0, false
+}
+
+// Put caches `message` if it answers exactly one question.
+func (cache *dnsCache) Put(message *dnsmessage.Message) {
+	if len(message.Questions) != 1 {
+		return
+	}
+	ttl, ok := cacheTTL(message)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if len(cache.entries) >= dnsMaxCacheSize {
+		for question, entry := range cache.entries {
+			if entry.expire.Before(now) {
+				delete(cache.entries, question)
+			}
+		}
+		// Drops an arbitrary entry if nothing expired.
+		for question := range cache.entries {
+			if len(cache.entries) < dnsMaxCacheSize {
+				break
+			}
+			delete(cache.entries, question)
+		}
+	}
+	cache.entries[message.Questions[0]] = &dnsCacheEntry{message: *message, stored: now, expire: now.Add(ttl)}
+}
+
+// Get returns the cached response to `question` with TTLs reduced by the time it has been cached.
+func (cache *dnsCache) Get(question dnsmessage.Question) (dnsmessage.Message, bool) {
+	now := time.Now()
+	cache.mu.Lock()
+	entry, exist := cache.entries[question]
+	if exist && entry.expire.Before(now) {
+		delete(cache.entries, question)
+		exist = false
+	}
+	cache.mu.Unlock()
+	if !exist {
+		return dnsmessage.Message{}, false
+	}
+	elapsed := uint32(now.Sub(entry.stored) / time.Second)
+	message := entry.message
+	for _, section := range []*[]dnsmessage.Resource{&message.Answers, &message.Authorities, &message.Additionals} {
+		resources := make([]dnsmessage.Resource, len(*section))
+		for i, resource := range *section {
+			if resource.Header.Type != dnsmessage.TypeOPT {
+				if resource.Header.TTL > elapsed {
+					resource.Header.TTL -= elapsed
+				} else {
+					resource.Header.TTL = 0
+				}
+			}
+			resources[i] = resource
+		}
+		*section = resources
+	}
+	return message, true
+}
+
+// tunnelDial is a dial of the shared tunnel in progress, `done` is closed once it finishes.
+type tunnelDial struct {
+	done   chan struct{}
+	tunnel net.Conn
+	err    error
+}
+
+// dnsForwarder sends queries to the endpoint through a shared tunnel, and caches the responses.
+type dnsForwarder struct {
+	Dialer  func(network, address string) (net.Conn, error)
+	cache   *dnsCache
+	mu      sync.Mutex
+	tunnel  net.Conn
+	dialing *tunnelDial
+	closed  bool
+	pending map[uint16]chan []byte
+	nextID  uint16
+}
+
+func newDNSForwarder(Dialer func(network, address string) (net.Conn, error)) *dnsForwarder {
+	return &dnsForwarder{Dialer: Dialer, cache: newDNSCache(), pending: map[uint16]chan []byte{}}
+}
+
+// getTunnel returns the shared tunnel, creating one if there is none. The tunnel is dialed without holding the lock,
+// concurrent callers wait for the same dial.
+func (forwarder *dnsForwarder) getTunnel() (net.Conn, error) {
+	forwarder.mu.Lock()
+	if forwarder.closed {
+		forwarder.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	if forwarder.tunnel != nil {
+		defer forwarder.mu.Unlock()
+		return forwarder.tunnel, nil
+	}
+	if dial := forwarder.dialing; dial != nil {
+		forwarder.mu.Unlock()
+		<-dial.done
+		return dial.tunnel, dial.err
+	}
+	dial := &tunnelDial{done: make(chan struct{})}
+	forwarder.dialing = dial
+	forwarder.mu.Unlock()
+
+	tunnel, err := forwarder.Dialer("dns", "0.0.0.0:53")
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	forwarder.dialing = nil
+	if err == nil && forwarder.closed {
+		tunnel.Close()
+		err = net.ErrClosed
+	}
+	if err == nil {
+		forwarder.tunnel = tunnel
+		dial.tunnel = tunnel
+		go forwarder.readResponses(tunnel)
+	}
+	dial.err = err
+	close(dial.done)
+	return dial.tunnel, dial.err
+}
+
+// Close closes the shared tunnel, queries fail afterwards.
+func (forwarder *dnsForwarder) Close() error {
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	forwarder.closed = true
+	if forwarder.tunnel != nil {
+		return forwarder.tunnel.Close()
+	}
+	return nil
+}
+
+// readResponses dispatches responses from `tunnel` to pending queries until the tunnel is closed.
+func (forwarder *dnsForwarder) readResponses(tunnel net.Conn) {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, err := tunnel.Read(buf)
+		if err != nil || n < 2 {
+			break
+		}
+		forwarder.mu.Lock()
+		pending, exist := forwarder.pending[binary.BigEndian.Uint16(buf)]
+		forwarder.mu.Unlock()
+		if exist {
+			select {
+			case pending <- append([]byte{}, buf[:n]...):
+			default:
+			}
+		}
+	}
+	tunnel.Close()
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	if forwarder.tunnel == tunnel {
+		forwarder.tunnel = nil
+	}
+}
+
+// exchange sends `query` through the tunnel with an ID unique among pending queries, and waits for the response.
+func (forwarder *dnsForwarder) exchange(query []byte) ([]byte, error) {
+	tunnel, err := forwarder.getTunnel()
+	if err != nil {
+		return nil, err
+	}
+	result := make(chan []byte, 1)
+	forwarder.mu.Lock()
+	if len(forwarder.pending) >= 0xffff {
+		forwarder.mu.Unlock()
+		return nil, fmt.Errorf("too many pending queries")
+	}
+	for _, exist := forwarder.pending[forwarder.nextID]; exist; _, exist = forwarder.pending[forwarder.nextID] {
+		forwarder.nextID++
+	}
+	id := forwarder.nextID
+	forwarder.nextID++
+	forwarder.pending[id] = result
+	forwarder.mu.Unlock()
+	defer func() {
+		forwarder.mu.Lock()
+		delete(forwarder.pending, id)
+		forwarder.mu.Unlock()
+	}()
+
+	tunnelQuery := append([]byte{}, query...)
+	binary.BigEndian.PutUint16(tunnelQuery, id)
+	if _, err := tunnel.Write(tunnelQuery); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	select {
+	case answer := <-result:
+		copy(answer, query[:2])
+		return answer, nil
+	case <-time.After(dnsQueryTimeout):
+		return nil, fmt.Errorf("dns query timed out")
+	}
+}
+
+// Resolve answers `query` from the cache or through the endpoint.
+func (forwarder *dnsForwarder) Resolve(query []byte) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+	if message, ok := forwarder.cache.Get(question); ok {
+		message.ID = header.ID
+		return message.Pack()
+	}
+	answer, err := forwarder.exchange(query)
+	if err != nil {
+		log.Printf("dns: %s failed: %v", question.Name.String(), err)
+		return dnsFailureResponse(query, dnsmessage.RCodeServerFailure)
+	}
+	message := dnsmessage.Message{}
+	if err := message.Unpack(answer); err == nil {
+		forwarder.cache.Put(&message)
+	}
+	return answer, nil
+}
+
+// StartDNSService serves DNS queries on `LocalAddress` over both UDP and TCP, and resolves them through `Dialer`.
+// The TCP listener and connections are drained by `Tracker`, UDP queries are ignored once draining starts.
+func StartDNSService(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, Tracker *connectionTracker) error {
+	forwarder := newDNSForwarder(Dialer)
+	defer forwarder.Close()
+	udpConn, err := net.ListenPacket("udp", LocalAddress)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	listener, err := net.Listen("tcp", LocalAddress)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	serveContext, cancelFn := context.WithCancel(RuntimeContext)
+	defer cancelFn()
+	go func() {
+		<-serveContext.Done()
+		udpConn.Close()
+		listener.Close()
+	}()
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				// Draining closes the listener, the UDP side keeps running until the process exits.
+				if !Tracker.Draining() {
+					cancelFn()
+				}
+				return
+			}
+			if !Tracker.Track(conn) {
+				conn.Close()
+				continue
+			}
+			go func(conn net.Conn) {
+				defer Tracker.Untrack(conn)
+				defer conn.Close()
+				datagramConn := newDatagramConn(conn)
+				buf := make([]byte, maxDatagramSize)
+				for {
+					conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+					n, err := datagramConn.Read(buf)
+					if err != nil {
+						return
+					}
+					answer, err := forwarder.Resolve(buf[:n])
+					if err != nil {
+						return
+					}
+					if _, err := datagramConn.Write(answer); err != nil {
+						return
+					}
+				}
+			}(conn)
+		}
+	}()
+	slots := make(chan struct{}, dnsMaxConcurrency)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := udpConn.ReadFrom(buf)
+		if err != nil {
+			if serveContext.Err() != nil {
+				return serveContext.Err()
+			}
+			return err
+		}
+		if Tracker.Draining() {
+			continue
+		}
+		slots <- struct{}{}
+		go func(query []byte, addr net.Addr) {
+			defer func() { <-slots }()
+			answer, err := forwarder.Resolve(query)
+			if err != nil {
+				return
+			}
+			udpConn.WriteTo(answer, addr)
+		}(append([]byte{}, buf[:n]...), addr)
+	}
+}
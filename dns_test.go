@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// startDNSServer starts a name server answering every A query with 192.0.2.1, returns its address and query counter.
+func startDNSServer(t *testing.T) (string, *int32) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	counter := new(int32)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(counter, 1)
+			query := dnsmessage.Message{}
+			if err := query.Unpack(buf[:n]); err != nil {
+				continue
+			}
+			answer := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+				Questions: query.Questions,
+				Answers: []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: query.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}},
+			}
+			data, _ := answer.Pack()
+			conn.WriteTo(data, addr)
+		}
+	}()
+	return conn.LocalAddr().String(), counter
+}
+
+func buildQuery(t *testing.T, id uint16, name string) []byte {
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestDNSForwarder(t *testing.T) {
+	serverAddress, counter := startDNSServer(t)
+	defaultResolver := endpointDNS
+	resolver, err := newEndpointResolver(serverAddress, false, "", "", ipFamilyAny, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpointDNS = resolver
+	defer func() { endpointDNS = defaultResolver }()
+	proxyAddress := startProxyServer(t)
+
+	forwarder := newDNSForwarder(func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		return proxyHandshake(conn, network, address, false, false)
+	})
+	defer forwarder.Close()
+	for i, id := range []uint16{7, 9} {
+		answer, err := forwarder.Resolve(buildQuery(t, id, "example.com."))
+		if err != nil {
+			t.Fatal(err)
+		}
+		message := dnsmessage.Message{}
+		if err := message.Unpack(answer); err != nil {
+			t.Fatal(err)
+		}
+		if message.ID != id {
+			t.Errorf("response %d has ID %d, expect %d", i, message.ID, id)
+		}
+		if len(message.Answers) != 1 || message.Answers[0].Body.(*dnsmessage.AResource).A != [4]byte{192, 0, 2, 1} {
+			t.Errorf("unexpected answers: %v", message.Answers)
+		}
+	}
+	if queries := atomic.LoadInt32(counter); queries != 1 {
+		t.Errorf("expect the second query to be cached, name server got %d queries", queries)
+	}
+}
+
+func TestDNSFamilyExcludes(t *testing.T) {
+	for _, c := range []struct {
+		family   string
+		qtype    dnsmessage.Type
+		excludes bool
+	}{
+		{ipFamilyIPv4, dnsmessage.TypeAAAA, true},
+		{ipFamilyIPv4, dnsmessage.TypeA, false},
+		{ipFamilyIPv6, dnsmessage.TypeA, true},
+		{ipFamilyPreferIPv4, dnsmessage.TypeAAAA, false},
+		{ipFamilyIPv6, dnsmessage.TypeMX, false},
+	} {
+		if excludes := dnsFamilyExcludes(c.family, c.qtype); excludes != c.excludes {
+			t.Errorf("family %s, type %v: excludes is %v, expect %v", c.family, c.qtype, excludes, c.excludes)
+		}
+	}
+}
+
+func TestDNSForwarderTunnel(t *testing.T) {
+	var dials int32
+	remote := make(chan net.Conn, 10)
+	forwarder := newDNSForwarder(func(network, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(50 * time.Millisecond)
+		local, remoteEnd := net.Pipe()
+		remote <- remoteEnd
+		return local, nil
+	})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := forwarder.getTunnel(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if dials := atomic.LoadInt32(&dials); dials != 1 {
+		t.Errorf("expect concurrent queries to share one dial, got %d", dials)
+	}
+
+	forwarder.Close()
+	remoteEnd := <-remote
+	remoteEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remoteEnd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect the tunnel to be closed, got %v", err)
+	}
+	if _, err := forwarder.getTunnel(); err == nil {
+		t.Error("expect no tunnel after the forwarder is closed")
+	}
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	cache := newDNSCache()
+	question := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	message := &dnsmessage.Message{
+		Header:    dnsmessage.Header{Response: true},
+		Questions: []dnsmessage.Question{question},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			Body:   &dnsmessage.AResource{},
+		}},
+	}
+	cache.Put(message)
+	cache.entries[question].stored = time.Now().Add(-10 * time.Second)
+	cached, ok := cache.Get(question)
+	if !ok {
+		t.Fatal("expect a cached response")
+	}
+	if ttl := cached.Answers[0].Header.TTL; ttl != 50 {
+		t.Errorf("expect the TTL to be reduced to 50, got %d", ttl)
+	}
+	if message.Answers[0].Header.TTL != 60 {
+		t.Error("the cached message should not be modified")
+	}
+	cache.entries[question].expire = time.Now().Add(-time.Second)
+	if _, ok := cache.Get(question); ok {
+		t.Error("expect expired responses to be dropped")
+	}
+
+	message.RCode = dnsmessage.RCodeServerFailure
+	cache.Put(message)
+	if _, ok := cache.Get(question); ok {
+		t.Error("expect failures not to be cached")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// connectionTracker records the listeners and connections of running services. Draining closes the listeners so
+// that no connection is accepted anymore, and lets the connections being served finish before a deadline.
+type connectionTracker struct {
+	mu        sync.Mutex
+	draining  bool
+	listeners map[io.Closer]struct{}
+	conns     map[net.Conn]struct{}
+	// Receives a value whenever a connection is untracked.
+	changed chan struct{}
+}
+
+func newConnectionTracker() *connectionTracker {
+	return &connectionTracker{
+		listeners: map[io.Closer]struct{}{},
+		conns:     map[net.Conn]struct{}{},
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// activeConnections tracks the connections served by this process, it is passed to the services started by main.
+var activeConnections = newConnectionTracker()
+
+// TrackListener registers `listener` to be closed once draining starts. It is closed immediately if already draining.
+func (tracker *connectionTracker) TrackListener(listener io.Closer) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.draining {
+		listener.Close()
+		return
+	}
+	tracker.listeners[listener] = struct{}{}
+}
+
+func (tracker *connectionTracker) UntrackListener(listener io.Closer) {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	delete(tracker.listeners, listener)
+}
+
+// Track registers a connection being served. Returns false if draining, the connection should be closed then.
+func (tracker *connectionTracker) Track(conn net.Conn) bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	if tracker.draining {
+		return false
+	}
+	tracker.conns[conn] = struct{}{}
+	return true
+}
+
+func (tracker *connectionTracker) Untrack(conn net.Conn) {
+	tracker.mu.Lock()
+	delete(tracker.conns, conn)
+	tracker.mu.Unlock()
+	select {
+	case tracker.changed <- struct{}{}:
+	default:
+	}
+}
+
+// trackedConn is a connection untracked once closed, for connections not served by a single goroutine.
+type trackedConn struct {
+	net.Conn
+	tracker *connectionTracker
+	once    sync.Once
+}
+
+// TrackConn registers `conn` like Track, and returns a connection untracking it once closed.
+// Returns false if draining, `conn` should be closed then.
+func (tracker *connectionTracker) TrackConn(conn net.Conn) (net.Conn, bool) {
+	if !tracker.Track(conn) {
+		return nil, false
+	}
+	return &trackedConn{Conn: conn, tracker: tracker}, true
+}
+
+func (conn *trackedConn) Close() error {
+	err := conn.Conn.Close()
+	conn.once.Do(func() { conn.tracker.Untrack(conn.Conn) })
+	return err
+}
+
+// Draining returns true once draining starts.
+func (tracker *connectionTracker) Draining() bool {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return tracker.draining
+}
+
+// Drain stops accepting connections and waits up to `timeout` for tracked connections to finish.
+// Connections still open after that are closed. Returns the number of connections closed by force.
+func (tracker *connectionTracker) Drain(timeout time.Duration) int {
+	tracker.mu.Lock()
+	tracker.draining = true
+	for listener := range tracker.listeners {
+		listener.Close()
+	}
+	tracker.listeners = map[io.Closer]struct{}{}
+	tracker.mu.Unlock()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for tracker.count() > 0 {
+		select {
+		case <-tracker.changed:
+		case <-deadline.C:
+			return tracker.closeAll()
+		}
+	}
+	return 0
+}
+
+func (tracker *connectionTracker) count() int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	return len(tracker.conns)
+}
+
+// closeAll closes every tracked connection, returns the number of them.
+func (tracker *connectionTracker) closeAll() int {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	for conn := range tracker.conns {
+		conn.Close()
+	}
+	return len(tracker.conns)
+}
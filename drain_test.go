@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startDrainableForward starts a TCP forward to an echo server, drained by the returned tracker.
+func startDrainableForward(t *testing.T) (*connectionTracker, string) {
+	tracker := newConnectionTracker()
+	echoAddress, localAddress := startEchoServer(t), unusedAddress(t, "tcp")
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+	go StartTCPForward(ctx, net.Dial, localAddress, echoAddress, tracker)
+	return tracker, localAddress
+}
+
+func dialDrainableForward(t *testing.T, address string) net.Conn {
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", address); err == nil {
+			return conn
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal(err)
+	return nil
+}
+
+// openDrainableRelay dials `address` and performs `handshake` on the connection, the result relays to an echo server.
+func openDrainableRelay(t *testing.T, address string, handshake func(conn net.Conn) (net.Conn, error)) net.Conn {
+	conn := dialDrainableForward(t, address)
+	if handshake == nil {
+		return conn
+	}
+	conn, err := handshake(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// expectDrainWaits drains `tracker` while a connection to `address` is open, and expects new connections to be
+// refused and draining to finish once the open connection is closed.
+func expectDrainWaits(t *testing.T, tracker *connectionTracker, address string) {
+	expectRelayDrainWaits(t, tracker, address, nil)
+}
+
+// expectRelayDrainWaits is expectDrainWaits for services requiring `handshake` before relaying.
+func expectRelayDrainWaits(t *testing.T, tracker *connectionTracker, address string, handshake func(conn net.Conn) (net.Conn, error)) {
+	conn := openDrainableRelay(t, address, handshake)
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	drained := make(chan int, 1)
+	go func() { drained <- tracker.Drain(time.Minute) }()
+
+	// The listener is closed, new connections are refused.
+	refused := false
+	for i := 0; i < 50 && !refused; i++ {
+		if newConn, err := net.Dial("tcp", address); err != nil {
+			refused = true
+		} else {
+			newConn.Close()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+	if !refused {
+		t.Fatal("expect new connections to be refused while draining")
+	}
+
+	// The open session keeps working until the client closes it.
+	expectEcho(t, conn)
+	select {
+	case <-drained:
+		t.Fatal("expect draining to wait for the open connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	conn.Close()
+	select {
+	case closed := <-drained:
+		if closed != 0 {
+			t.Errorf("expect no connection closed by force, got %d", closed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("draining does not finish after the connection is closed")
+	}
+}
+
+func TestDrainWaitsForConnections(t *testing.T) {
+	tracker, address := startDrainableForward(t)
+	expectDrainWaits(t, tracker, address)
+}
+
+func TestDrainReverseForward(t *testing.T) {
+	tracker := newConnectionTracker()
+	expectDrainWaits(t, tracker, startTestReverseForward(t, tracker))
+}
+
+// expectRelayDrainTimeout drains `tracker` while a relay to `address` is open, and expects the relay to be closed
+// by force once the timeout passes.
+func expectRelayDrainTimeout(t *testing.T, tracker *connectionTracker, address string, handshake func(conn net.Conn) (net.Conn, error)) {
+	conn := openDrainableRelay(t, address, handshake)
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	if closed := tracker.Drain(100 * time.Millisecond); closed != 1 {
+		t.Errorf("expect 1 connection closed by force, got %d", closed)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("expect the connection to be closed after the timeout")
+	}
+	if tracker.Track(conn) {
+		t.Error("expect no connection to be tracked after draining")
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	tracker, address := startDrainableForward(t)
+	expectRelayDrainTimeout(t, tracker, address, nil)
+}
+
+// startDrainableSocks5 starts a SOCKS5 proxy drained by the returned tracker, and returns a handshake connecting
+// through it to an echo server.
+func startDrainableSocks5(t *testing.T) (*connectionTracker, string, func(conn net.Conn) (net.Conn, error)) {
+	tracker := newConnectionTracker()
+	echoAddress := startEchoServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+	go StartProxyClientWithListener(ctx, net.Dial, listener.Addr().String(), listener, nil, tracker)
+	handshake := func(conn net.Conn) (net.Conn, error) {
+		echoAddr, err := net.ResolveTCPAddr("tcp", echoAddress)
+		if err != nil {
+			return nil, err
+		}
+		request := bytes.NewBuffer([]byte{5, 1, 0, 5, 1, 0})
+		if err := writeIPAndPort(request, echoAddr); err != nil {
+			return nil, err
+		}
+		if _, err := request.WriteTo(conn); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			return nil, err
+		}
+		readSocks5Reply(t, conn)
+		return conn, nil
+	}
+	return tracker, listener.Addr().String(), handshake
+}
+
+// startDrainableEndpoint starts a proxy server drained by the returned tracker, and returns a handshake connecting
+// through it to an echo server.
+func startDrainableEndpoint(t *testing.T) (*connectionTracker, string, func(conn net.Conn) (net.Conn, error)) {
+	tracker := newConnectionTracker()
+	echoAddress := startEchoServer(t)
+	handshake := func(conn net.Conn) (net.Conn, error) {
+		return proxyHandshake(conn, "tcp", echoAddress, false, false)
+	}
+	return tracker, startReverseProxyServer(t, nil, tracker), handshake
+}
+
+func TestDrainSocks5Client(t *testing.T) {
+	tracker, address, handshake := startDrainableSocks5(t)
+	expectRelayDrainWaits(t, tracker, address, handshake)
+	tracker, address, handshake = startDrainableSocks5(t)
+	expectRelayDrainTimeout(t, tracker, address, handshake)
+}
+
+func TestDrainEndpoint(t *testing.T) {
+	tracker, address, handshake := startDrainableEndpoint(t)
+	expectRelayDrainWaits(t, tracker, address, handshake)
+	tracker, address, handshake = startDrainableEndpoint(t)
+	expectRelayDrainTimeout(t, tracker, address, handshake)
+}
@@ -162,7 +162,10 @@ func (channelmap *ActiveChannelPool) lookupOrCreateChannel(ctx context.Context,
 	channelmap.channelMap[id] = channel
 	channelmap.mu.Unlock()
 	go func() {
-		if _, err := io.Copy(&channelSender{FanInSender: sender, ID: id, Channel: channel}, channel.connection); err != nil {
+		// Uses a full size buffer so that datagrams coming from `connection` are never truncated.
+		buf := channelmap.pool.Get().(*bufObj)
+		defer channelmap.pool.Put(buf)
+		if _, err := io.CopyBuffer(&channelSender{FanInSender: sender, ID: id, Channel: channel}, channel.connection, buf.data); err != nil {
 			if err != nil {
 				log.Printf("error: %v", err)
 			}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/xpy123993/clover3/fan"
+)
+
+// forwardRule describes a static forward from a local port to a fixed address behind a channel.
+type forwardRule struct {
+	Network       string
+	Channel       string
+	LocalPort     string
+	RemoteAddress string
+}
+
+// parseForwardRule parses `[channel]:[local port]:[remote host]:[remote port]` with an optional `/tcp` or `/udp` suffix.
+func parseForwardRule(rule string) (forwardRule, error) {
+	forward := forwardRule{Network: "tcp"}
+	if index := strings.LastIndex(rule, "/"); index >= 0 {
+		forward.Network = rule[index+1:]
+		rule = rule[:index]
+		if forward.Network != "tcp" && forward.Network != "udp" {
+			return forwardRule{}, fmt.Errorf("unknown network `%s` in forward rule", forward.Network)
+		}
+	}
+	parts := strings.SplitN(rule, ":", 3)
+	if len(parts) != 3 || len(parts[0]) == 0 {
+		return forwardRule{}, fmt.Errorf("invalid forward rule `%s`, expect channel:localport:remotehost:remoteport", rule)
+	}
+	forward.Channel, forward.LocalPort, forward.RemoteAddress = parts[0], parts[1], parts[2]
+	if _, _, err := net.SplitHostPort(forward.RemoteAddress); err != nil {
+		return forwardRule{}, fmt.Errorf("invalid remote address in forward rule `%s`: %v", rule, err)
+	}
+	return forward, nil
+}
+
+// parseForwardRules parses forward rules splitted by `,`.
+func parseForwardRules(list string) ([]forwardRule, error) {
+	rules := []forwardRule{}
+	for _, rawRule := range strings.Split(list, ",") {
+		if rawRule = strings.TrimSpace(rawRule); len(rawRule) == 0 {
+			continue
+		}
+		rule, err := parseForwardRule(rawRule)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// StartTCPForward accepts connections on `LocalAddress` and connects each of them to `RemoteAddress` through `Dialer`.
+// The listener and the connections are drained by `Tracker`.
+func StartTCPForward(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress, RemoteAddress string, Tracker *connectionTracker) error {
+	listener, err := net.Listen("tcp", LocalAddress)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-RuntimeContext.Done()
+		listener.Close()
+	}()
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
+	for RuntimeContext.Err() == nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !Tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer Tracker.Untrack(conn)
+			defer conn.Close()
+			remoteConn, err := Dialer("tcp", RemoteAddress)
+			if err != nil {
+				log.Printf("forward to %s failed: %v", RemoteAddress, err)
+				return
+			}
+			defer remoteConn.Close()
+			ctx, cancelFn := context.WithCancel(RuntimeContext)
+			go func() { io.Copy(conn, remoteConn); cancelFn() }()
+			go func() { io.Copy(remoteConn, conn); cancelFn() }()
+			<-ctx.Done()
+		}(conn)
+	}
+	return RuntimeContext.Err()
+}
+
+// StartUDPForward relays datagrams received on `LocalAddress` to `RemoteAddress` through `Dialer`.
+// Each source address gets its own tunnel, which is closed after being idle for `Timeout`. Tunnels are drained by
+// `Tracker`, no tunnel is created while draining.
+func StartUDPForward(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress, RemoteAddress string, Timeout time.Duration, Tracker *connectionTracker) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", LocalAddress)
+	if err != nil {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	serveContext, cancelFn := context.WithCancel(RuntimeContext)
+	defer cancelFn()
+	go func() {
+		<-serveContext.Done()
+		udpConn.Close()
+	}()
+	channelPool := fan.NewChannelPool(serveContext, &fan.RedirectionConfig{Timeout: Timeout, BufferSize: maxDatagramSize})
+	return fan.RedirectFanIn(serveContext, channelPool, func(buf []byte) (int, int, string, error) {
+		n, sender, err := udpConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if serveContext.Err() != nil {
+				return -1, -1, "", io.EOF
+			}
+			return -1, -1, "", err
+		}
+		return 0, n, sender.String(), nil
+	}, func(b []byte, s string) (int, error) {
+		sender, err := netip.ParseAddrPort(s)
+		if err != nil {
+			return -1, err
+		}
+		return udpConn.WriteToUDPAddrPort(b, sender)
+	}, func(s string) (net.Conn, error) {
+		tunnel, err := Dialer("udp", RemoteAddress)
+		if err != nil {
+			return nil, err
+		}
+		trackedTunnel, ok := Tracker.TrackConn(tunnel)
+		if !ok {
+			tunnel.Close()
+			return nil, fmt.Errorf("udp forward to %s: draining, %s is dropped", RemoteAddress, s)
+		}
+		return trackedTunnel, nil
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseForwardRules(t *testing.T) {
+	rules, err := parseForwardRules("home:8080:10.0.0.1:80, office:5353:[fd00::1]:53/udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []forwardRule{
+		{Network: "tcp", Channel: "home", LocalPort: "8080", RemoteAddress: "10.0.0.1:80"},
+		{Network: "udp", Channel: "office", LocalPort: "5353", RemoteAddress: "[fd00::1]:53"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("expect %d rules, got %d", len(expected), len(rules))
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("rule %d mismatch: %+v, expect %+v", i, rules[i], expected[i])
+		}
+	}
+	for _, invalid := range []string{"home:8080", "home:8080:10.0.0.1", "home:8080:10.0.0.1:80/sctp", ":8080:10.0.0.1:80"} {
+		if _, err := parseForwardRules(invalid); err == nil {
+			t.Errorf("expect an error on `%s`", invalid)
+		}
+	}
+}
+
+// unusedAddress returns a local address nothing is listening on.
+func unusedAddress(t *testing.T, network string) string {
+	var listener io.Closer
+	var address string
+	if network == "tcp" {
+		tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, address = tcpListener, tcpListener.Addr().String()
+	} else {
+		udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listener, address = udpConn, udpConn.LocalAddr().String()
+	}
+	listener.Close()
+	return address
+}
+
+func TestTCPForward(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	localAddress := unusedAddress(t, "tcp")
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go StartTCPForward(ctx, net.Dial, localAddress, echoAddress, newConnectionTracker())
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", localAddress); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+func TestUDPForward(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoConn.Close()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, addr, err := echoConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	localAddress := unusedAddress(t, "udp")
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	go StartUDPForward(ctx, net.Dial, localAddress, echoConn.LocalAddr().String(), time.Minute, newConnectionTracker())
+
+	// Each client has its own session, replies must go back to the right source.
+	clients := []net.Conn{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", localAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	buf := make([]byte, maxDatagramSize)
+	for i, conn := range clients {
+		message := []byte{byte(i), 'p', 'i', 'n', 'g'}
+		received := false
+		// The forward might not be listening yet, retries until the echo comes back.
+		for attempt := 0; attempt < 20 && !received; attempt++ {
+			conn.Write(message)
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			n, err := conn.Read(buf)
+			if err != nil {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			if !bytes.Equal(buf[:n], message) {
+				t.Fatalf("client %d got unexpected reply: %v", i, buf[:n])
+			}
+			received = true
+		}
+		if !received {
+			t.Fatalf("client %d got no reply", i)
+		}
+	}
+}
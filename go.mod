@@ -5,6 +5,7 @@ go 1.20
 require (
 	github.com/quic-go/quic-go v0.40.1
 	github.com/xpy123993/corenet v0.0.75
+	golang.org/x/net v0.17.0
 )
 
 require (
@@ -28,7 +29,6 @@ require (
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/exp v0.0.0-20230213192124-5e25df0256eb // indirect
 	golang.org/x/mod v0.11.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/tools v0.9.1 // indirect
 )
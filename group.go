@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Channel groups like `a|b|c` spread requests over several channels serving the same network.
+// Channels failing health checks or dials are skipped until they recover, and only used if every channel fails.
+//
+//	failover:      prefers channels in the listed order.
+//	round-robin:   rotates among healthy channels.
+//	least-latency: prefers the channel with the lowest handshake latency in the last health check.
+
+const (
+	groupPolicyFailover     = "failover"
+	groupPolicyRoundRobin   = "round-robin"
+	groupPolicyLeastLatency = "least-latency"
+)
+
+type groupMember struct {
+	channel string
+	dial    func(network, address string) (net.Conn, error)
+	healthy bool
+	latency time.Duration
+}
+
+// channelGroup dials through the members picked by its policy.
+type channelGroup struct {
+	policy  string
+	probe   func(channel string) (time.Duration, error)
+	mu      sync.Mutex
+	members []*groupMember
+	next    int
+}
+
+// isChannelGroup returns true if `channel` lists several channels splitted by `|`.
+func isChannelGroup(channel string) bool {
+	return strings.Contains(channel, "|")
+}
+
+func checkGroupPolicy(policy string) error {
+	if policy != groupPolicyFailover && policy != groupPolicyRoundRobin && policy != groupPolicyLeastLatency {
+		return fmt.Errorf("unknown channel group policy `%s`, expect %s, %s or %s", policy, groupPolicyFailover, groupPolicyRoundRobin, groupPolicyLeastLatency)
+	}
+	return nil
+}
+
+// newChannelGroup creates a group of the channels in `group` splitted by `|`.
+// `channelDialer` creates the dialer of a channel, `probe` connects to a channel and returns the latency.
+func newChannelGroup(group, policy string, channelDialer func(channel string) func(network, address string) (net.Conn, error), probe func(channel string) (time.Duration, error)) (*channelGroup, error) {
+	if err := checkGroupPolicy(policy); err != nil {
+		return nil, err
+	}
+	channels := strings.Split(group, "|")
+	for _, channel := range channels {
+		if len(strings.TrimSpace(channel)) == 0 {
+			return nil, fmt.Errorf("empty channel in group `%s`", group)
+		}
+	}
+	members := []*groupMember{}
+	for _, channel := range channels {
+		channel = strings.TrimSpace(channel)
+		members = append(members, &groupMember{channel: channel, dial: channelDialer(channel), healthy: true})
+	}
+	return &channelGroup{policy: policy, probe: probe, members: members}, nil
+}
+
+// candidates returns the members in the order to try.
+func (group *channelGroup) candidates() []*groupMember {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	healthy, unhealthy := []*groupMember{}, []*groupMember{}
+	for _, member := range group.members {
+		if member.healthy {
+			healthy = append(healthy, member)
+		} else {
+			unhealthy = append(unhealthy, member)
+		}
+	}
+	switch group.policy {
+	case groupPolicyRoundRobin:
+		if len(healthy) > 0 {
+			offset := group.next % len(healthy)
+			group.next++
+			healthy = append(healthy[offset:], healthy[:offset]...)
+		}
+	case groupPolicyLeastLatency:
+		sort.SliceStable(healthy, func(i, j int) bool { return healthy[i].latency < healthy[j].latency })
+	}
+	return append(healthy, unhealthy...)
+}
+
+func (group *channelGroup) setHealth(member *groupMember, healthy bool, latency time.Duration) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	if member.healthy && !healthy {
+		log.Printf("Channel `%s` is unhealthy", member.channel)
+	}
+	if !member.healthy && healthy {
+		log.Printf("Channel `%s` is healthy again", member.channel)
+	}
+	member.healthy = healthy
+	if healthy && latency > 0 {
+		member.latency = latency
+	}
+}
+
+// Dial connects to `address` through the first member that works.
+// Errors reported by endpoints are returned directly as they are about the destination rather than the channel.
+func (group *channelGroup) Dial(network, address string) (net.Conn, error) {
+	var lastErr error
+	for _, member := range group.candidates() {
+		conn, err := member.dial(network, address)
+		var remoteErr *remoteError
+		if err == nil || errors.As(err, &remoteErr) {
+			group.setHealth(member, true, 0)
+			return conn, err
+		}
+		log.Printf("Channel `%s` failed, trying the next one: %v", member.channel, err)
+		group.setHealth(member, false, 0)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// CheckHealth probes every member and updates their health and latency.
+func (group *channelGroup) CheckHealth() {
+	wg := sync.WaitGroup{}
+	for _, member := range group.members {
+		wg.Add(1)
+		go func(member *groupMember) {
+			defer wg.Done()
+			latency, err := group.probe(member.channel)
+			group.setHealth(member, err == nil, latency)
+		}(member)
+	}
+	wg.Wait()
+}
+
+// StartHealthCheck probes members every `interval` until `ctx` is done. `interval` must be positive.
+func (group *channelGroup) StartHealthCheck(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		group.CheckHealth()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
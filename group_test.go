@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChannelGroup(t *testing.T) {
+	down := map[string]bool{}
+	latencies := map[string]time.Duration{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond, "c": 20 * time.Millisecond}
+	newGroup := func(policy string) *channelGroup {
+		group, err := newChannelGroup("a|b|c", policy, func(channel string) func(network, address string) (net.Conn, error) {
+			return func(network, address string) (net.Conn, error) {
+				if down[channel] {
+					return nil, errors.New("channel is down")
+				}
+				if address == "refused:80" {
+					return nil, &remoteError{Class: errorClassConnectionRefused}
+				}
+				conn, _ := net.Pipe()
+				return &proxyConn{Conn: conn, localAddr: &net.TCPAddr{Port: int(channel[0])}}, nil
+			}
+		}, func(channel string) (time.Duration, error) {
+			if down[channel] {
+				return 0, errors.New("channel is down")
+			}
+			return latencies[channel], nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return group
+	}
+	dialedChannel := func(group *channelGroup) string {
+		conn, err := group.Dial("tcp", "example.com:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return string(rune(conn.LocalAddr().(*net.TCPAddr).Port))
+	}
+
+	group := newGroup(groupPolicyFailover)
+	if channel := dialedChannel(group); channel != "a" {
+		t.Errorf("expect the first channel, got %s", channel)
+	}
+	down["a"] = true
+	if channel := dialedChannel(group); channel != "b" {
+		t.Errorf("expect failing over to b, got %s", channel)
+	}
+	// Errors of destinations do not fail over.
+	if _, err := group.Dial("tcp", "refused:80"); socks5ReplyCode(err) != socks5ReplyConnectionRefused {
+		t.Errorf("expect the endpoint error, got %v", err)
+	}
+	down["a"] = false
+	group.CheckHealth()
+	if channel := dialedChannel(group); channel != "a" {
+		t.Errorf("expect a to recover, got %s", channel)
+	}
+
+	group = newGroup(groupPolicyRoundRobin)
+	dialed := ""
+	for i := 0; i < 4; i++ {
+		dialed += dialedChannel(group)
+	}
+	if dialed != "abca" {
+		t.Errorf("unexpected round robin order: %s", dialed)
+	}
+
+	group = newGroup(groupPolicyLeastLatency)
+	group.CheckHealth()
+	if channel := dialedChannel(group); channel != "b" {
+		t.Errorf("expect the fastest channel, got %s", channel)
+	}
+	down["a"], down["b"], down["c"] = true, true, true
+	if _, err := group.Dial("tcp", "example.com:80"); err == nil {
+		t.Error("expect an error if every channel is down")
+	}
+
+	if _, err := newChannelGroup("a||b", groupPolicyFailover, nil, nil); err == nil {
+		t.Error("expect an error on empty channel")
+	}
+	if _, err := newChannelGroup("a|b", "random", nil, nil); err == nil {
+		t.Error("expect an error on unknown policy")
+	}
+}
+
+func TestGroupServiceSettings(t *testing.T) {
+	flags := newFlagMirror(cmdFlags)
+	if err := flags.Parse([]string{"-socks5-list", "a|b:0,c:0", "-channel-health-interval", "0s"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildLocalServices(flags, nil, "host-a"); err == nil {
+		t.Error("expect an error if the health check interval is not positive")
+	}
+
+	keys := func(policy string) []string {
+		flags.Set("channel-health-interval", "30s")
+		flags.Set("channel-group-policy", policy)
+		services, err := buildLocalServices(flags, nil, "host-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for _, service := range services {
+			keys = append(keys, service.Key)
+		}
+		return keys
+	}
+	failover, roundRobin := keys(groupPolicyFailover), keys(groupPolicyRoundRobin)
+	if failover[0] == roundRobin[0] {
+		t.Error("expect the service using a group to restart when the policy changes")
+	}
+	if failover[1] != roundRobin[1] {
+		t.Error("expect the service without groups to keep running when the policy changes")
+	}
+}
+
+func TestGroupHealthCheckStops(t *testing.T) {
+	probed := make(chan string, 10)
+	group, err := newChannelGroup("a|b", groupPolicyFailover, func(channel string) func(network, address string) (net.Conn, error) {
+		return nil
+	}, func(channel string) (time.Duration, error) {
+		probed <- channel
+		return time.Millisecond, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		group.StartHealthCheck(ctx, time.Hour)
+		close(done)
+	}()
+	<-probed
+	<-probed
+	cancelFn()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect health checks to stop with the context")
+	}
+}
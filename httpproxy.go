@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// hopHeaders are meaningful only for a single connection and must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			header.Del(strings.TrimSpace(name))
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// httpStatusCode maps the error returned by the dialer to the status replied to HTTP clients.
+func httpStatusCode(err error) int {
+	switch errorClassOf(err) {
+	case errorClassNotAllowed:
+		return http.StatusForbidden
+	case errorClassTTLExpired:
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// httpProxyHandler serves HTTP CONNECT and absolute-URI forward proxy requests through `Dialer`.
+type httpProxyHandler struct {
+	Dialer      func(network, address string) (net.Conn, error)
+	Credentials *Socks5Credentials
+	transport   *http.Transport
+	tracker     *connectionTracker
+}
+
+// dialWithContext dials `address` with `Dialer`, which takes no context, and gives up once `ctx` is done.
+// A connection dialed after that is closed.
+func dialWithContext(ctx context.Context, Dialer func(network, address string) (net.Conn, error), network, address string) (net.Conn, error) {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	result := make(chan dialResult, 1)
+	go func() {
+		conn, err := Dialer(network, address)
+		result <- dialResult{conn: conn, err: err}
+	}()
+	select {
+	case dialed := <-result:
+		return dialed.conn, dialed.err
+	case <-ctx.Done():
+		go func() {
+			if dialed := <-result; dialed.conn != nil {
+				dialed.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func newHTTPProxyHandler(Dialer func(network, address string) (net.Conn, error), Credentials *Socks5Credentials, tracker *connectionTracker) *httpProxyHandler {
+	return &httpProxyHandler{
+		Dialer:      Dialer,
+		Credentials: Credentials,
+		tracker:     tracker,
+		transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialWithContext(ctx, Dialer, network, address)
+			},
+			MaxIdleConnsPerHost:   4,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+	}
+}
+
+// authorize checks the basic credentials in `Proxy-Authorization` if credentials are configured.
+func (handler *httpProxyHandler) authorize(r *http.Request) bool {
+	if handler.Credentials.Empty() {
+		return true
+	}
+	scheme, encoded, found := strings.Cut(r.Header.Get("Proxy-Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Basic") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+	username, password, found := strings.Cut(string(decoded), ":")
+	return found && handler.Credentials.Verify(username, password)
+}
+
+func (handler *httpProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !handler.authorize(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="clover3"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		handler.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() || len(r.URL.Host) == 0 {
+		http.Error(w, "this is a proxy, an absolute URI is required", http.StatusBadRequest)
+		return
+	}
+	outRequest := r.Clone(r.Context())
+	outRequest.RequestURI = ""
+	removeHopHeaders(outRequest.Header)
+	resp, err := handler.transport.RoundTrip(outRequest)
+	if err != nil {
+		log.Printf("http proxy: %s %s failed: %v", r.Method, r.URL.String(), err)
+		http.Error(w, err.Error(), httpStatusCode(err))
+		return
+	}
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	// Flushes as data arrives so that streaming responses are not delayed.
+	if flusher, ok := w.(http.Flusher); ok {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := resp.Body.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	io.Copy(w, resp.Body)
+}
+
+func (handler *httpProxyHandler) serveConnect(w http.ResponseWriter, r *http.Request) {
+	address := r.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+	// Gives up once the client goes away.
+	remoteConn, err := dialWithContext(r.Context(), handler.Dialer, "tcp", address)
+	if err != nil {
+		log.Printf("http proxy: CONNECT %s failed: %v", address, err)
+		http.Error(w, err.Error(), httpStatusCode(err))
+		return
+	}
+	defer remoteConn.Close()
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking is not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	// The connection was tracked by the server when the request became active.
+	defer handler.tracker.Untrack(conn)
+	defer conn.Close()
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		return
+	}
+	ctx, cancelFn := context.WithCancel(r.Context())
+	// Reads through `bufrw` as the client might have sent data along with the request.
+	go func() { io.Copy(conn, remoteConn); cancelFn() }()
+	go func() { io.Copy(remoteConn, bufrw); cancelFn() }()
+	<-ctx.Done()
+}
+
+// connListener is a listener serving connections accepted somewhere else.
+type connListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{addr: addr, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// Push hands `conn` to the next Accept call.
+func (listener *connListener) Push(conn net.Conn) error {
+	select {
+	case listener.conns <- conn:
+		return nil
+	case <-listener.done:
+		return net.ErrClosed
+	}
+}
+
+func (listener *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *connListener) Close() error {
+	listener.closeOnce.Do(func() { close(listener.done) })
+	return nil
+}
+
+func (listener *connListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// StartHTTPProxyClient creates a local HTTP proxy service, and forward traffic through `Dialer`.
+// If `Credentials` is not empty, clients are required to authenticate with basic credentials.
+// Connections serving requests are drained by `Tracker`.
+func StartHTTPProxyClient(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, Credentials *Socks5Credentials, Tracker *connectionTracker) error {
+	listener, err := net.Listen("tcp", LocalAddress)
+	if err != nil {
+		return err
+	}
+	return StartHTTPProxyClientWithListener(RuntimeContext, Dialer, listener, Credentials, Tracker)
+}
+
+// StartHTTPProxyClientWithListener starts an HTTP proxy on `listener`.
+func StartHTTPProxyClientWithListener(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), listener net.Listener, Credentials *Socks5Credentials, Tracker *connectionTracker) error {
+	server := &http.Server{
+		Handler:           newHTTPProxyHandler(Dialer, Credentials, Tracker),
+		ReadHeaderTimeout: 30 * time.Second,
+		// Only connections serving requests are tracked, idle keep-alive connections do not delay draining.
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			switch state {
+			case http.StateActive:
+				if !Tracker.Track(conn) {
+					conn.Close()
+				}
+			case http.StateIdle, http.StateClosed:
+				Tracker.Untrack(conn)
+			}
+		},
+	}
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
+	go func() {
+		<-RuntimeContext.Done()
+		server.Close()
+	}()
+	return server.Serve(listener)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func startHTTPProxy(t *testing.T, credentials *Socks5Credentials) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+	go StartHTTPProxyClientWithListener(ctx, net.Dial, listener, credentials, newConnectionTracker())
+	return listener.Addr().String()
+}
+
+func TestHTTPProxyConnect(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	proxyAddress := startHTTPProxy(t, nil)
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("CONNECT " + echoAddress + " HTTP/1.1\r\nHost: " + echoAddress + "\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	expectEcho(t, conn)
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.Header.Get("Proxy-Authorization")) > 0 {
+			t.Error("Proxy-Authorization should not be forwarded")
+		}
+		io.WriteString(w, "hello "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	credentials := NewSocks5Credentials()
+	credentials.Add("alice", "secret")
+	proxyAddress := startHTTPProxy(t, credentials)
+
+	for _, testCase := range []struct {
+		user   *url.Userinfo
+		status int
+	}{
+		{url.UserPassword("alice", "secret"), http.StatusOK},
+		{url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{nil, http.StatusProxyAuthRequired},
+	} {
+		proxyURL := &url.URL{Scheme: "http", Host: proxyAddress, User: testCase.user}
+		client := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := client.Get(server.URL + "/world")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != testCase.status {
+			t.Errorf("expect status %d, got %d", testCase.status, resp.StatusCode)
+		}
+		if testCase.status == http.StatusOK && string(body) != "hello /world" {
+			t.Errorf("unexpected body: %s", body)
+		}
+	}
+}
+
+func TestDialWithContext(t *testing.T) {
+	release := make(chan struct{})
+	remote := make(chan net.Conn, 1)
+	dialer := func(network, address string) (net.Conn, error) {
+		<-release
+		local, remoteEnd := net.Pipe()
+		remote <- remoteEnd
+		return local, nil
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	cancelFn()
+	if _, err := dialWithContext(ctx, dialer, "tcp", "example.com:80"); err != context.Canceled {
+		t.Errorf("expect the dial to give up once the context is done, got %v", err)
+	}
+
+	// The connection dialed after giving up is closed.
+	close(release)
+	remoteEnd := <-remote
+	remoteEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := remoteEnd.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expect the late connection to be closed, got %v", err)
+	}
+}
+
+func TestHTTPProxyConnectClientGone(t *testing.T) {
+	dialing, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	dialer := func(network, address string) (net.Conn, error) {
+		dialing <- struct{}{}
+		<-release
+		return nil, io.EOF
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	tracker := newConnectionTracker()
+	go StartHTTPProxyClientWithListener(ctx, dialer, listener, nil, tracker)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	<-dialing
+	conn.Close()
+	// The request stops waiting for the dial, so the connection is no longer active.
+	for i := 0; tracker.count() > 0; i++ {
+		if i == 250 {
+			t.Fatal("expect the CONNECT request to give up once the client is gone")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -23,16 +24,56 @@ import (
 
 var (
 	cmdFlags        = flag.NewFlagSet("clover3", flag.ExitOnError)
+	configFile      = cmdFlags.String("config", "", "If not empty, flags are also loaded from this JSON config file. Command arguments and `CLOVER_*` environment variables override it.")
+	tlsCAFile       = cmdFlags.String("tls-ca", "", "The CA certificate file. If empty, `CLOVER_CA` or the embedded ca.crt is used.")
+	tlsCertFile     = cmdFlags.String("tls-cert", "", "The certificate file. If empty, `CLOVER_CRT` or the embedded cert.crt is used.")
+	tlsKeyFile      = cmdFlags.String("tls-key", "", "The private key file. If empty, `CLOVER_KEY` or the embedded cert.key is used.")
+	revocationFile  = cmdFlags.String("revocation-list", "", "If not empty, peers with certificates in this file are rejected by relay, endpoint and client connections. Either CRLs issued by the CA (PEM or DER), or lines of `serial=<hex>` or `name=<name>`. Reloaded with certificates.")
 	serverRelay     = cmdFlags.Bool("serve-bridge", false, "If true, a relay server will be created to serve `bridge-url`.")
 	relayServerURLs = cmdFlags.String("bridge-url", "", "The URL of the relay server. Can be multiple splitted by `,`")
 
 	channel             = cmdFlags.String("endpoint-channel", "", "If specified, an endpoint service will be created on that channel.")
 	serverLocalPort     = cmdFlags.Int("endpoint-channel-direct-port", -1, "If non-negative and channel is not empty, the endpoint server will also listen on a direct port.")
-	localSocks5AddrPair = cmdFlags.String("socks5-list", "", "The list of [channel]:[local socks5 ports], splitted by `,`")
-	exposeLocalAddr     = cmdFlags.Bool("socks5-public", false, "If true, socks5 port will be served at 0.0.0.0. By default only listen on 127.0.0.1")
+	localSocks5AddrPair = cmdFlags.String("socks5-list", "", "The list of [channel]:[local socks5 ports], splitted by `,`. These ports also serve socks4/4a and http proxy requests. A channel can be a group like `a|b|c`.")
+	localHTTPAddrPair   = cmdFlags.String("http-proxy-list", "", "The list of [channel]:[local http proxy ports], splitted by `,`")
+	localDNSAddrPair    = cmdFlags.String("dns-list", "", "The list of [channel]:[local dns ports] resolving names with the endpoint's name servers, splitted by `,`. Served over both UDP and TCP.")
+	localForwardList    = cmdFlags.String("forward", "", "The list of static forwards [channel]:[local port]:[remote host]:[remote port], splitted by `,`. Append `/udp` to forward UDP.")
+	reverseForwardList  = cmdFlags.String("reverse-forward", "", "The list of reverse forwards [channel]:[endpoint port]:[local host]:[local port], splitted by `,`. The endpoint listens on the port and forwards connections to the local address.")
+	transparentList     = cmdFlags.String("transparent-list", "", "The list of [channel]:[local transparent proxy ports] receiving traffic redirected by iptables or nftables, splitted by `,`.")
+	transparentMode     = cmdFlags.String("transparent-mode", "redirect", "How traffic is redirected to transparent proxy ports, redirect (TCP only) or tproxy (TCP and UDP). Linux only.")
+	forwardUDPTimeout   = cmdFlags.Duration("forward-udp-timeout", time.Minute, "The idle timeout of the tunnel created for each source of a UDP forward or transparent proxy.")
+	routeRules          = cmdFlags.String("route", "", "The routing rules of local proxy services, splitted by `;`. For example: `office domain=corp.example.com;direct cidr=private;reject port=25`.")
+	routeChannels       = cmdFlags.String("route-channels", "", "The channels only used by routing rules, splitted by `,`. Rules can target these and the channels of local services.")
+	routeFile           = cmdFlags.String("route-file", "", "If not empty, routing rules of local proxy services will also be read from this file, one rule per line.")
+	channelGroupPolicy  = cmdFlags.String("channel-group-policy", "failover", "How channel groups like `a|b|c` pick channels: failover, round-robin or least-latency.")
+	groupCheckInterval  = cmdFlags.Duration("channel-health-interval", 30*time.Second, "The interval of health checks on channels in channel groups, must be positive.")
+	exposeLocalAddr     = cmdFlags.Bool("socks5-public", false, "If true, socks5, http proxy, forward and transparent proxy ports will be served at 0.0.0.0. By default only listen on 127.0.0.1")
+	socks5Auth          = cmdFlags.String("socks5-auth", "", "The list of [user]:[password] accepted by socks5 and http proxy services, splitted by `,`. Also read from `CLOVER_SOCKS5_AUTH`.")
+	socks5AuthFile      = cmdFlags.String("socks5-auth-file", "", "If not empty, socks5 credentials will also be read from this file, one [user]:[password] per line.")
+	socks5AllowUsers    = cmdFlags.String("socks5-allow-users", "", "If not empty, only these socks5 users are accepted, splitted by `,`.")
+	socks5DenyUsers     = cmdFlags.String("socks5-deny-users", "", "The list of socks5 users to be rejected, splitted by `,`.")
 	debugPprof          = cmdFlags.String("pprof-address", "", "If not empty, a web server will be started to provide pprof.")
+	endpointACLRules    = cmdFlags.String("endpoint-acl", "", "The access control rules of the endpoint service, splitted by `;`. For example: `deny cidr=loopback;allow port=443`.")
+	endpointACLFile     = cmdFlags.String("endpoint-acl-file", "", "If not empty, access control rules of the endpoint service will also be read from this file, one rule per line.")
+	endpointReverse     = cmdFlags.Bool("endpoint-reverse", false, "If true, the endpoint service accepts reverse forwards, letting peers open listeners on the endpoint host. Restrict them with `reverse` rules in `endpoint-acl`.")
+	reversePublicPorts  = cmdFlags.Bool("endpoint-reverse-public", false, "If true, ports of reverse forwards will be served at all interfaces of the endpoint host. By default only listen on 127.0.0.1")
+	endpointACLDefault  = cmdFlags.String("endpoint-acl-default", "allow", "The action for destinations matching no access control rule, allow or deny.")
+	endpointDNSServers  = cmdFlags.String("endpoint-dns-servers", "", "The name servers used by the endpoint service, splitted by `,`. The system ones are used if empty.")
+	endpointDNSTCP      = cmdFlags.Bool("endpoint-dns-tcp", false, "If true, the endpoint service sends DNS queries over TCP only. Otherwise TCP is used if UDP fails or the response is truncated.")
+	endpointHosts       = cmdFlags.String("endpoint-hosts", "", "The static names of the endpoint service, like `name=ip,ip;name=ip`.")
+	endpointHostsFile   = cmdFlags.String("endpoint-hosts-file", "", "If not empty, static names of the endpoint service will also be read from this file, in the format of /etc/hosts.")
+	endpointIPFamily    = cmdFlags.String("endpoint-ip-family", "any", "The IP family the endpoint service connects to: any, ipv4, ipv6, prefer-ipv4 or prefer-ipv6.")
+	happyEyeballsDelay  = cmdFlags.Duration("endpoint-happy-eyeballs-delay", 300*time.Millisecond, "The delay before the endpoint service races the next address of a destination. Addresses are dialed one by one if zero.")
 	socks5DialTimeout   = cmdFlags.Duration("socks5-dial-timeout", 10*time.Second, "The timeout for the proxy server to dial to an address.")
+	socks5Optimistic    = cmdFlags.Bool("socks5-optimistic-connect", false, "If true, socks5 CONNECT requests are replied before the endpoint confirms them to save a round trip. Dial errors will show up as closed connections.")
+	socks5BindTimeout   = cmdFlags.Duration("socks5-bind-timeout", 2*time.Minute, "The timeout for the proxy server to wait for a peer on a socks5 bind request.")
+	reloadInterval      = cmdFlags.Duration("reload-interval", 0, "If positive, the config file, TLS files, socks5 credential file and routing rule file are checked for changes at this interval and reloaded as on SIGHUP.")
+	certWarnBefore      = cmdFlags.Duration("cert-warn-before", 14*24*time.Hour, "Warn when the certificate expires within this duration, and run `cert-renew-command` if set.")
+	certCheckInterval   = cmdFlags.Duration("cert-check-interval", time.Hour, "The interval of checking the certificate expiry, only checked at startup if not positive. The remaining validity is exported as `certificate_remaining_seconds` in /debug/vars of the pprof server.")
+	certRenewCommand    = cmdFlags.String("cert-renew-command", "", "If not empty, this shell command runs when the certificate is about to expire, then TLS material is reloaded. It should write the renewed files to `tls-cert` and `tls-key` (or CLOVER_CRT and CLOVER_KEY). Files renewed by other means are picked up with `reload-interval`.")
+	drainTimeout        = cmdFlags.Duration("drain-timeout", 30*time.Second, "On SIGINT or SIGTERM, stop accepting connections and wait up to this long for open ones to finish. A second signal exits immediately. Disabled if zero.")
 	templateTLSConfig   *tls.Config
+	endpointACL         *accessControlList
 
 	exitSig     = make(chan struct{}, 1)
 	relayServer *corenet.RelayServer
@@ -62,12 +103,13 @@ func serveRelay() error {
 	return nil
 }
 
-func serveEndpointService(channelName string) error {
+// listenChannel serves `channelName` on every relay, and on `directPort` if it is non-negative.
+func listenChannel(channelName string, directPort int) (net.Listener, error) {
 	adapters := []corenet.ListenerAdapter{}
-	if *serverLocalPort >= 0 {
+	if directPort >= 0 {
 		key := make([]byte, 32)
 		rand.Read(key)
-		directAdapter, err := corenet.CreateListenerAESTCPPortAdapter(*serverLocalPort, key)
+		directAdapter, err := corenet.CreateListenerAESTCPPortAdapter(directPort, key)
 		if err != nil {
 			log.Printf("Warning: listening on local port failed: %v", err)
 		} else {
@@ -95,48 +137,361 @@ func serveEndpointService(channelName string) error {
 		}
 	}
 	if len(adapters) == 0 {
-		return fmt.Errorf("no active listeners")
+		return nil, fmt.Errorf("no active listeners")
+	}
+	return corenet.NewMultiListener(adapters...), nil
+}
+
+func serveEndpointService(channelName string, reverseDialer func(peer, channel string) (net.Conn, error)) error {
+	listener, err := listenChannel(channelName, *serverLocalPort)
+	if err != nil {
+		return err
 	}
-	listener := corenet.NewMultiListener(adapters...)
 	defer listener.Close()
-	return handleProxyServer(tls.NewListener(listener, templateTLSConfig))
+	return handleProxyServer(tls.NewListener(listener, templateTLSConfig), reverseDialer, activeConnections)
 }
 
-func serveLocalSocks5(channel, localAddr string, dialer *corenet.Dialer, tlsConfig *tls.Config) error {
-	log.Printf("Socks5 service `%s` -> `%s`", channel, localAddr)
-	return StartProxyClient(context.Background(), func(network, address string) (net.Conn, error) {
-		conn, err := proxyDial(dialer, channel, network, address, tlsConfig)
+// channelTLSConfig returns the TLS config verifying the service on `channel`, named by the part before `@`.
+// Called for every connection, so that reloaded certificates are used.
+func channelTLSConfig(channel string) *tls.Config {
+	tlsConfig := activeTLSConfig.Load().Clone()
+	tlsConfig.ServerName = channel
+	if strings.Contains(channel, "@") {
+		tlsConfig.ServerName = channel[:strings.Index(channel, "@")]
+	}
+	return tlsConfig
+}
+
+// channelDialer returns the dialer connecting through the endpoint on `channel`.
+func channelDialer(dialer *corenet.Dialer, channel string) func(network, address string) (net.Conn, error) {
+	return func(network, address string) (net.Conn, error) {
+		conn, err := proxyDial(dialer, channel, network, address, channelTLSConfig(channel), *socks5Optimistic)
 		if err != nil {
 			return nil, err
 		}
 		return conn, nil
-	}, localAddr)
+	}
 }
 
-func initialize() error {
-	tlsConfig, err := getTLSConfigFromEnv()
-	if err == nil {
-		templateTLSConfig = tlsConfig
-		return nil
+// probeChannel connects to the endpoint on `channel` and returns the time to finish the TLS handshake.
+func probeChannel(dialer *corenet.Dialer, channel string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := dialer.Dial(channel)
+	if err != nil {
+		return 0, err
 	}
-	tlsConfig, err = getTLSConfigFromEmbeded()
-	if err == nil {
-		templateTLSConfig = tlsConfig
-		return nil
+	defer conn.Close()
+	tlsConn := tls.Client(conn, channelTLSConfig(channel))
+	tlsConn.SetDeadline(time.Now().Add(*socks5DialTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return 0, err
 	}
-	return fmt.Errorf("no available token, last error: %v", err)
+	return time.Since(start), nil
 }
 
-func main() {
-	defer close(exitSig)
+// groupSettings configures the channel groups of local services.
+type groupSettings struct {
+	Policy   string
+	Interval time.Duration
+}
+
+// serviceDialer returns the dialer of `channel`, which might be a channel group.
+// Each service creates its own groups, their health checks stop once `ctx` is done.
+func serviceDialer(ctx context.Context, dialer *corenet.Dialer, channel string, groups groupSettings) (func(network, address string) (net.Conn, error), error) {
+	if !isChannelGroup(channel) {
+		return channelDialer(dialer, channel), nil
+	}
+	group, err := newChannelGroup(channel, groups.Policy, func(channel string) func(network, address string) (net.Conn, error) {
+		return channelDialer(dialer, channel)
+	}, func(channel string) (time.Duration, error) {
+		return probeChannel(dialer, channel)
+	})
+	if err != nil {
+		return nil, err
+	}
+	go group.StartHealthCheck(ctx, groups.Interval)
+	return group.Dial, nil
+}
+
+// proxyServiceDialer returns the dialer of a local proxy service on `channel`, applying `routes` if not nil.
+func proxyServiceDialer(ctx context.Context, dialer *corenet.Dialer, routes *routingTable, channel string, groups groupSettings) (func(network, address string) (net.Conn, error), error) {
+	if routes == nil {
+		return serviceDialer(ctx, dialer, channel, groups)
+	}
+	return routeDialer(routes, channel, func(channel string) (func(network, address string) (net.Conn, error), error) {
+		return serviceDialer(ctx, dialer, channel, groups)
+	})
+}
+
+func serveLocalSocks5(ctx context.Context, channel, localAddr string, dialer *corenet.Dialer, routes *routingTable, groups groupSettings, credentials *Socks5Credentials) error {
+	dial, err := proxyServiceDialer(ctx, dialer, routes, channel, groups)
+	if err != nil {
+		return err
+	}
+	log.Printf("Socks5 service `%s` -> `%s`", channel, localAddr)
+	return StartProxyClient(ctx, dial, localAddr, credentials, activeConnections)
+}
+
+func serveLocalDNS(ctx context.Context, channel, localAddr string, dialer *corenet.Dialer, groups groupSettings) error {
+	dial, err := serviceDialer(ctx, dialer, channel, groups)
+	if err != nil {
+		return err
+	}
+	log.Printf("DNS service `%s` -> `%s`", channel, localAddr)
+	return StartDNSService(ctx, dial, localAddr, activeConnections)
+}
+
+func serveLocalForward(ctx context.Context, rule forwardRule, localAddr string, dialer *corenet.Dialer, groups groupSettings, udpTimeout time.Duration) error {
+	forwardDialer, err := serviceDialer(ctx, dialer, rule.Channel, groups)
+	if err != nil {
+		return err
+	}
+	log.Printf("Forward service %s `%s` -> `%s` via `%s`", rule.Network, localAddr, rule.RemoteAddress, rule.Channel)
+	if rule.Network == "udp" {
+		return StartUDPForward(ctx, forwardDialer, localAddr, rule.RemoteAddress, udpTimeout, activeConnections)
+	}
+	return StartTCPForward(ctx, forwardDialer, localAddr, rule.RemoteAddress, activeConnections)
+}
+
+func serveReverseForward(ctx context.Context, rule reverseForwardRule, dialer *corenet.Dialer, certName string) error {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	callbackChannel := fmt.Sprintf("%s@reverse-%x", certName, suffix)
+	listener, err := listenChannel(callbackChannel, -1)
+	if err != nil {
+		return err
+	}
+	log.Printf("Reverse forward service `%s` port %s -> `%s`", rule.Channel, rule.EndpointPort, rule.LocalAddress)
+	return StartReverseForward(ctx, func() (net.Conn, net.Addr, error) {
+		conn, err := dialer.Dial(rule.Channel)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConn := tls.Client(conn, channelTLSConfig(rule.Channel))
+		boundAddr, err := registerReverseForward(tlsConn, net.JoinHostPort("", rule.EndpointPort), callbackChannel)
+		return tlsConn, boundAddr, err
+	}, tls.NewListener(listener, templateTLSConfig), channelTLSConfig(rule.Channel).ServerName, rule.LocalAddress, activeConnections)
+}
+
+func serveLocalTransparentProxy(ctx context.Context, channel, localAddr, mode string, dialer *corenet.Dialer, routes *routingTable, groups groupSettings, udpTimeout time.Duration) error {
+	dial, err := proxyServiceDialer(ctx, dialer, routes, channel, groups)
+	if err != nil {
+		return err
+	}
+	log.Printf("Transparent proxy service (%s) `%s` -> `%s`", mode, channel, localAddr)
+	return StartTransparentProxy(ctx, dial, localAddr, mode == "tproxy", udpTimeout, activeConnections)
+}
+
+func serveLocalHTTPProxy(ctx context.Context, channel, localAddr string, dialer *corenet.Dialer, routes *routingTable, groups groupSettings, credentials *Socks5Credentials) error {
+	dial, err := proxyServiceDialer(ctx, dialer, routes, channel, groups)
+	if err != nil {
+		return err
+	}
+	log.Printf("HTTP proxy service `%s` -> `%s`", channel, localAddr)
+	return StartHTTPProxyClient(ctx, dial, localAddr, credentials, activeConnections)
+}
+
+// localServiceAddress returns the address a local service listens on `port`.
+func localServiceAddress(port string, public bool) string {
+	if public {
+		return fmt.Sprintf(":%s", port)
+	}
+	return fmt.Sprintf("127.0.0.1:%s", port)
+}
 
-	if data, err := embeddedFile.ReadFile("tokens/cmdline.txt"); err == nil {
-		cmdFlags.Parse(strings.Split(string(data), "\n"))
-		if len(os.Args) > 1 {
-			log.Printf("WARNING: This binary is compiled with built-in configs, all command arguments will be ignored")
+// parseLocalServiceList parses `[channel]:[port]` pairs splitted by `,` into channels and local addresses.
+func parseLocalServiceList(list string, public bool) ([][2]string, error) {
+	services := [][2]string{}
+	for _, address := range strings.Split(list, ",") {
+		channel, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		cmdFlags.Parse(os.Args[1:])
+		services = append(services, [2]string{channel, localServiceAddress(port, public)})
+	}
+	return services, nil
+}
+
+// buildLocalServices creates the client side services configured in `flags`.
+// Keys include every setting a service depends on, so that reloads only restart services whose settings changed.
+func buildLocalServices(flags *flag.FlagSet, dialer *corenet.Dialer, certName string) ([]localService, error) {
+	value := func(name string) string { return flags.Lookup(name).Value.String() }
+	public, err := strconv.ParseBool(value("socks5-public"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid socks5-public: %v", err)
+	}
+	udpTimeout, err := time.ParseDuration(value("forward-udp-timeout"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid forward-udp-timeout: %v", err)
+	}
+	credentials, err := loadSocks5Credentials(value("socks5-auth"), value("socks5-auth-file"), value("socks5-allow-users"), value("socks5-deny-users"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load socks5 credentials: %v", err)
+	}
+	routes, err := loadRoutingTable(value("route"), value("route-file"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot load routing rules: %v", err)
+	}
+	groups := groupSettings{Policy: value("channel-group-policy")}
+	if err := checkGroupPolicy(groups.Policy); err != nil {
+		return nil, err
+	}
+	if groups.Interval, err = time.ParseDuration(value("channel-health-interval")); err != nil || groups.Interval <= 0 {
+		return nil, fmt.Errorf("invalid channel-health-interval `%s`, expect a positive duration", value("channel-health-interval"))
+	}
+	if credentials == nil && public {
+		log.Printf("WARNING: proxy services are public without authentication")
+	}
+	credentialKey := settingsKey(value("socks5-auth"), value("socks5-allow-users"), value("socks5-deny-users"), fileDigest(value("socks5-auth-file")))
+	routeKey := settingsKey(value("route"), fileDigest(value("route-file")))
+	routeTargets := []string{}
+	if routes != nil {
+		routeTargets = routes.Targets()
+	}
+	// groupKey returns the group settings if any of `channels` is a group, so that only services using groups
+	// restart when the settings change.
+	groupKey := func(channels ...string) string {
+		for _, channel := range channels {
+			if isChannelGroup(channel) {
+				return settingsKey(groups.Policy, groups.Interval.String())
+			}
+		}
+		return ""
+	}
+
+	transparentNetworks := []string{"tcp"}
+	if value("transparent-mode") == "tproxy" {
+		transparentNetworks = append(transparentNetworks, "udp")
+	}
+
+	// Channels routing rules can target, see CheckTargets.
+	knownChannels := map[string]bool{}
+	addKnownChannel := func(channel string) {
+		for _, member := range strings.Split(channel, "|") {
+			knownChannels[strings.TrimSpace(member)] = true
+		}
+	}
+	if len(value("route-channels")) > 0 {
+		for _, channel := range strings.Split(value("route-channels"), ",") {
+			addKnownChannel(channel)
+		}
+	}
+
+	services := []localService{}
+	for _, list := range []struct {
+		kind     string
+		flag     string
+		key      string
+		networks []string
+		// If true, requests are routed by `routes`.
+		routed bool
+		serve  func(ctx context.Context, channel, localAddr string) error
+	}{
+		{kind: "socks5", flag: "socks5-list", key: settingsKey(credentialKey, routeKey), networks: []string{"tcp"}, routed: true, serve: func(ctx context.Context, channel, localAddr string) error {
+			return serveLocalSocks5(ctx, channel, localAddr, dialer, routes, groups, credentials)
+		}},
+		{kind: "http proxy", flag: "http-proxy-list", key: settingsKey(credentialKey, routeKey), networks: []string{"tcp"}, routed: true, serve: func(ctx context.Context, channel, localAddr string) error {
+			return serveLocalHTTPProxy(ctx, channel, localAddr, dialer, routes, groups, credentials)
+		}},
+		{kind: "dns", flag: "dns-list", networks: []string{"tcp", "udp"}, serve: func(ctx context.Context, channel, localAddr string) error {
+			return serveLocalDNS(ctx, channel, localAddr, dialer, groups)
+		}},
+		{kind: "transparent proxy", flag: "transparent-list", key: settingsKey(routeKey, value("transparent-mode"), udpTimeout.String()), networks: transparentNetworks, routed: true, serve: func(ctx context.Context, channel, localAddr string) error {
+			return serveLocalTransparentProxy(ctx, channel, localAddr, value("transparent-mode"), dialer, routes, groups, udpTimeout)
+		}},
+	} {
+		list := list
+		if len(value(list.flag)) == 0 {
+			continue
+		}
+		if list.flag == "transparent-list" && value("transparent-mode") != "redirect" && value("transparent-mode") != "tproxy" {
+			return nil, fmt.Errorf("unknown transparent proxy mode `%s`, expect redirect or tproxy", value("transparent-mode"))
+		}
+		pairs, err := parseLocalServiceList(value(list.flag), public)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse address tuples of %s: %v", list.flag, err)
+		}
+		for _, pair := range pairs {
+			channel, localAddr := pair[0], pair[1]
+			addKnownChannel(channel)
+			addresses := [][2]string{}
+			for _, network := range list.networks {
+				addresses = append(addresses, [2]string{network, localAddr})
+			}
+			channels := []string{channel}
+			if list.routed {
+				channels = append(channels, routeTargets...)
+			}
+			services = append(services, localService{
+				Name:      fmt.Sprintf("%s service (%s)", list.kind, channel),
+				Key:       settingsKey(list.kind, channel, localAddr, list.key, groupKey(channels...)),
+				Addresses: addresses,
+				Serve:     func(ctx context.Context) error { return list.serve(ctx, channel, localAddr) },
+			})
+		}
+	}
+	if len(value("forward")) > 0 {
+		rules, err := parseForwardRules(value("forward"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse forward rules: %v", err)
+		}
+		for _, rule := range rules {
+			rule, localAddr := rule, localServiceAddress(rule.LocalPort, public)
+			addKnownChannel(rule.Channel)
+			services = append(services, localService{
+				Name:      fmt.Sprintf("forward service (%s:%s)", rule.Network, rule.LocalPort),
+				Key:       settingsKey("forward", rule.Network, rule.Channel, localAddr, rule.RemoteAddress, udpTimeout.String(), groupKey(rule.Channel)),
+				Addresses: [][2]string{{rule.Network, localAddr}},
+				Serve: func(ctx context.Context) error {
+					return serveLocalForward(ctx, rule, localAddr, dialer, groups, udpTimeout)
+				},
+			})
+		}
+	}
+	if len(value("reverse-forward")) > 0 {
+		rules, err := parseReverseForwardRules(value("reverse-forward"))
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse reverse forward rules: %v", err)
+		}
+		for _, rule := range rules {
+			rule := rule
+			addKnownChannel(rule.Channel)
+			services = append(services, localService{
+				Name:  fmt.Sprintf("reverse forward service (%s:%s)", rule.Channel, rule.EndpointPort),
+				Key:   settingsKey("reverse-forward", rule.Channel, rule.EndpointPort, rule.LocalAddress),
+				Serve: func(ctx context.Context) error { return serveReverseForward(ctx, rule, dialer, certName) },
+			})
+		}
+	}
+	if routes != nil {
+		if err := routes.CheckTargets(knownChannels); err != nil {
+			return nil, fmt.Errorf("cannot load routing rules: %v", err)
+		}
+	}
+	return services, nil
+}
+
+func initialize() error {
+	tlsConfig, err := loadTLSConfig(*tlsCAFile, *tlsCertFile, *tlsKeyFile, *revocationFile)
+	if err != nil {
+		return err
+	}
+	activeTLSConfig.Store(tlsConfig)
+	templateTLSConfig = reloadableTLSConfig(tlsConfig)
+	return nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		if err := runCA(os.Args[2:]); err != nil {
+			log.Print(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if err := loadFlags(cmdFlags, os.Args[1:]); err != nil {
+		log.Printf("Cannot load configs: %v", err)
+		return
 	}
 
 	if err := initialize(); err != nil {
@@ -150,6 +505,7 @@ func main() {
 		return
 	}
 	log.Printf("SSO: I am %s", certName)
+	publishCertificateMetrics()
 
 	if len(*debugPprof) > 0 {
 		go func() {
@@ -171,6 +527,8 @@ func main() {
 	osSignals := make(chan os.Signal, 1)
 	defer close(osSignals)
 	signal.Notify(osSignals, syscall.SIGABRT, syscall.SIGINT, syscall.SIGTERM)
+	osReloads := make(chan os.Signal, 1)
+	signal.Notify(osReloads, syscall.SIGHUP)
 
 	taskCounter := 0
 	if *serverRelay {
@@ -185,44 +543,65 @@ func main() {
 		if *channel != certName && !strings.HasPrefix(*channel, certName+"@") {
 			log.Printf("WARNING: channel name mismatch: Client might not trust the service")
 		}
+		endpointACL, err = loadAccessControlList(*endpointACLRules, *endpointACLFile, *endpointACLDefault)
+		if err != nil {
+			log.Printf("Cannot load access control rules: %v", err)
+			return
+		}
+		endpointDNS, err = newEndpointResolver(*endpointDNSServers, *endpointDNSTCP, *endpointHosts, *endpointHostsFile, *endpointIPFamily, *happyEyeballsDelay)
+		if err != nil {
+			log.Printf("Cannot configure the resolver: %v", err)
+			return
+		}
+		var reverseDialer func(peer, channel string) (net.Conn, error)
+		if *endpointReverse {
+			endpointDialer := corenet.NewDialer(strings.Split(*relayServerURLs, ","),
+				corenet.WithDialerRelayTLSConfig(templateTLSConfig))
+			defer endpointDialer.Close()
+			reverseDialer = func(peer, channel string) (net.Conn, error) {
+				conn, err := endpointDialer.Dial(channel)
+				if err != nil {
+					return nil, err
+				}
+				tlsConfig := activeTLSConfig.Load().Clone()
+				tlsConfig.ServerName = peer
+				return tls.Client(conn, tlsConfig), nil
+			}
+		}
 		taskCounter++
 		go func() {
-			if err := serveEndpointService(*channel); err != nil {
+			if err := serveEndpointService(*channel, reverseDialer); err != nil {
 				log.Printf("Endpoint service exited with error: %v", err)
 			}
 			exitSig <- struct{}{}
 		}()
 	}
 
-	if len(*localSocks5AddrPair) > 0 {
-		dialer := corenet.NewDialer(strings.Split(*relayServerURLs, ","),
-			corenet.WithDialerRelayTLSConfig(templateTLSConfig))
-		defer dialer.Close()
-		addressTuple := strings.Split(*localSocks5AddrPair, ",")
-		for _, address := range addressTuple {
-			channel, port, err := net.SplitHostPort(address)
-			if err != nil {
-				log.Printf("Cannot parse address tuples: %v", err)
-				return
-			}
-			localAddr := fmt.Sprintf("127.0.0.1:%s", port)
-			if *exposeLocalAddr {
-				localAddr = fmt.Sprintf(":%s", port)
+	dialer := corenet.NewDialer(strings.Split(*relayServerURLs, ","),
+		corenet.WithDialerRelayTLSConfig(templateTLSConfig))
+	defer dialer.Close()
+	services, err := buildLocalServices(cmdFlags, dialer, certName)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	taskCounter += len(services)
+	if _, _, err := localServices.Apply(services, true); err != nil {
+		log.Print(err)
+		return
+	}
+	go watchReload(osReloads, *reloadInterval, func() error { return reload(os.Args[1:], dialer, certName) })
+	var renew func(notAfter time.Time) error
+	if len(*certRenewCommand) > 0 {
+		renew = func(notAfter time.Time) error {
+			if err := runRenewCommand(*certRenewCommand, notAfter, renewCommandTimeout); err != nil {
+				return err
 			}
-			taskCounter++
-			go func() {
-				channelTLSConfig := templateTLSConfig.Clone()
-				channelTLSConfig.ServerName = channel
-				if strings.Contains(channel, "@") {
-					channelTLSConfig.ServerName = channel[:strings.Index(channel, "@")]
-				}
-				if err := serveLocalSocks5(channel, localAddr, dialer, channelTLSConfig); err != nil {
-					log.Printf("socks5 service (%s) exited with error: %v", channel, err)
-				}
-				exitSig <- struct{}{}
-			}()
+			return reload(os.Args[1:], dialer, certName)
 		}
 	}
+	go monitorCertificate(context.Background(), *certCheckInterval, *certWarnBefore, renew)
+
 	if taskCounter == 0 {
 		log.Printf("No pending work, exited.")
 		return
@@ -232,6 +611,17 @@ func main() {
 		log.Printf("One of the services exited.")
 	case res := <-osSignals:
 		log.Printf("Received signal: %v", res)
+		if *drainTimeout > 0 {
+			drained := make(chan int, 1)
+			go func() { drained <- activeConnections.Drain(*drainTimeout) }()
+			log.Printf("Draining connections for up to %v, send the signal again to exit immediately", *drainTimeout)
+			select {
+			case closed := <-drained:
+				log.Printf("Drained, %d connections closed by force", closed)
+			case res := <-osSignals:
+				log.Printf("Received signal: %v, exiting without draining", res)
+			}
+		}
 	}
 	if relayServer != nil {
 		relayServer.Close()
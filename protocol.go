@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// The handshake between clients and endpoints, all integers are big endian.
+//
+//	Request:  magic(1) version(1) method(1) flags(1) address_length(2) address metadata
+//	Response: magic(1) version(1) success(1) error_class(1) flags(1) payload_length(2) payload metadata
+//	Metadata: entries of type(1) length(2) value, terminated by type 0.
+//
+// Both sides send their own version. New fields are only added as metadata types, unknown types are ignored,
+// so peers of different versions can always parse each other.
+//
+// Peers of older versions speak gob. The magic byte is never a valid first byte of a gob stream, so endpoints
+// can tell both formats apart, and old endpoints reject the binary handshake without waiting for more data.
+
+const (
+	handshakeMagic   byte = 0x80
+	handshakeVersion byte = 1
+)
+
+const (
+	// The client asks to exchange UDP packets as framed datagrams.
+	handshakeFlagFramed byte = 1 << iota
+	// The client sends data right after the request without waiting for the response.
+	handshakeFlagOptimistic
+)
+
+// handshakeMethods maps method codes to networks, the index is the code on the wire.
+var handshakeMethods = []string{"", "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "bind", "udp-mux", "reverse", "dns"}
+
+// Metadata types, see the format above.
+const (
+	// The channel the endpoint connects accepted connections to for a reverse forward.
+	handshakeMetadataCallbackChannel byte = 1 + iota
+)
+
+var errLegacyPeer = errors.New("peer only speaks the legacy gob handshake")
+
+func methodCode(method string) (byte, error) {
+	for code, name := range handshakeMethods {
+		if code > 0 && name == method {
+			return byte(code), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported method: %s", method)
+}
+
+func writeMetadata(writer *bytes.Buffer, metadata map[byte][]byte) error {
+	for key, value := range metadata {
+		if key == 0 || len(value) > 0xffff {
+			return fmt.Errorf("invalid metadata entry %d", key)
+		}
+		writer.WriteByte(key)
+		binary.Write(writer, binary.BigEndian, uint16(len(value)))
+		writer.Write(value)
+	}
+	return writer.WriteByte(0)
+}
+
+func readMetadata(reader io.Reader) (map[byte][]byte, error) {
+	var metadata map[byte][]byte
+	header := make([]byte, 3)
+	for {
+		if _, err := io.ReadFull(reader, header[:1]); err != nil {
+			return nil, err
+		}
+		if header[0] == 0 {
+			return metadata, nil
+		}
+		if _, err := io.ReadFull(reader, header[1:]); err != nil {
+			return nil, err
+		}
+		value := make([]byte, binary.BigEndian.Uint16(header[1:]))
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		if metadata == nil {
+			metadata = map[byte][]byte{}
+		}
+		metadata[header[0]] = value
+	}
+}
+
+// readString reads a string prefixed with its length in 2 bytes.
+func readString(reader io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func writeString(writer *bytes.Buffer, data string) error {
+	if len(data) > 0xffff {
+		return fmt.Errorf("string too long: %d bytes", len(data))
+	}
+	binary.Write(writer, binary.BigEndian, uint16(len(data)))
+	writer.WriteString(data)
+	return nil
+}
+
+func encodeRequest(conn io.Writer, req request) error {
+	method, err := methodCode(req.Method)
+	if err != nil {
+		return err
+	}
+	flags := byte(0)
+	if req.Framed {
+		flags |= handshakeFlagFramed
+	}
+	if req.Optimistic {
+		flags |= handshakeFlagOptimistic
+	}
+	writer := new(bytes.Buffer)
+	writer.Write([]byte{handshakeMagic, handshakeVersion, method, flags})
+	if err := writeString(writer, req.Address); err != nil {
+		return err
+	}
+	if err := writeMetadata(writer, req.Metadata); err != nil {
+		return err
+	}
+	_, err = writer.WriteTo(conn)
+	return err
+}
+
+func decodeRequest(conn io.Reader) (request, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return request{}, err
+	}
+	if header[0] != handshakeMagic || header[1] == 0 {
+		return request{}, fmt.Errorf("invalid handshake header")
+	}
+	if int(header[2]) == 0 || int(header[2]) >= len(handshakeMethods) {
+		return request{}, fmt.Errorf("unsupported method code: %d", header[2])
+	}
+	req := request{
+		Method:     handshakeMethods[header[2]],
+		Framed:     header[3]&handshakeFlagFramed != 0,
+		Optimistic: header[3]&handshakeFlagOptimistic != 0,
+	}
+	var err error
+	if req.Address, err = readString(conn); err != nil {
+		return request{}, err
+	}
+	if req.Metadata, err = readMetadata(conn); err != nil {
+		return request{}, err
+	}
+	return req, nil
+}
+
+func encodeResponse(conn io.Writer, resp response) error {
+	success, flags := byte(0), byte(0)
+	if resp.Success {
+		success = 1
+	}
+	if resp.Framed {
+		flags |= handshakeFlagFramed
+	}
+	writer := new(bytes.Buffer)
+	writer.Write([]byte{handshakeMagic, handshakeVersion, success, byte(resp.ErrorClass), flags})
+	if err := writeString(writer, resp.Payload); err != nil {
+		return err
+	}
+	if err := writeMetadata(writer, resp.Metadata); err != nil {
+		return err
+	}
+	_, err := writer.WriteTo(conn)
+	return err
+}
+
+// decodeResponse reads a response, returns errLegacyPeer if the endpoint replied in gob.
+func decodeResponse(conn io.Reader) (response, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(conn, header[:1]); err != nil {
+		return response{}, err
+	}
+	if header[0] != handshakeMagic {
+		return response{}, errLegacyPeer
+	}
+	if _, err := io.ReadFull(conn, header[1:]); err != nil {
+		return response{}, err
+	}
+	resp := response{
+		Success:    header[2] == 1,
+		ErrorClass: errorClass(header[3]),
+		Framed:     header[4]&handshakeFlagFramed != 0,
+	}
+	var err error
+	if resp.Payload, err = readString(conn); err != nil {
+		return response{}, err
+	}
+	if resp.Metadata, err = readMetadata(conn); err != nil {
+		return response{}, err
+	}
+	return resp, nil
+}
+
+// bufferedConn reads through `reader`, so that the bytes peeked during the handshake are not lost.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// ReadByte allows gob to decode without buffering beyond the handshake.
+func (conn *bufferedConn) ReadByte() (byte, error) {
+	return conn.reader.ReadByte()
+}
+
+// acceptProxyRequest reads a request from `conn` in either the binary or the legacy gob format.
+// Returns the connection to serve the request with, and a function replying in the format the client speaks.
+func acceptProxyRequest(conn net.Conn) (net.Conn, request, func(response) error, error) {
+	clientconn := &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+	firstByte, err := clientconn.reader.Peek(1)
+	if err != nil {
+		return nil, request{}, nil, err
+	}
+	if firstByte[0] == handshakeMagic {
+		reply := func(resp response) error { return encodeResponse(clientconn, resp) }
+		req, err := decodeRequest(clientconn)
+		return clientconn, req, reply, err
+	}
+	encoder := gob.NewEncoder(clientconn)
+	reply := func(resp response) error { return encoder.Encode(resp) }
+	req := request{}
+	err = gob.NewDecoder(clientconn).Decode(&req)
+	return clientconn, req, reply, err
+}
+
+// sendProxyRequest sends `req` in the binary format, or in gob if `legacy` is true.
+// Returns a function reading responses in the same format.
+func sendProxyRequest(conn net.Conn, req request, legacy bool) (func() (response, error), error) {
+	if !legacy {
+		if err := encodeRequest(conn, req); err != nil {
+			return nil, err
+		}
+		return func() (response, error) { return decodeResponse(conn) }, nil
+	}
+	if err := gob.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	decoder := gob.NewDecoder(conn)
+	return func() (response, error) {
+		resp := response{}
+		err := decoder.Decode(&resp)
+		return resp, err
+	}, nil
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/xpy123993/corenet"
 )
@@ -15,20 +20,275 @@ import (
 type request struct {
 	Method  string
 	Address string
+	// If true, the client asks to exchange UDP packets as framed datagrams.
+	Framed bool
+	// If true, the client sends data before receiving the response. Only supported by the binary handshake.
+	Optimistic bool
+	// Optional entries keyed by type, see protocol.go.
+	Metadata map[byte][]byte
 }
 
 type response struct {
 	Success bool
 	Payload string
+	// Classifies the failure if `Success` is false. Peers of older versions always leave it as `errorClassGeneral`.
+	ErrorClass errorClass
+	// If true, the endpoint agrees to exchange UDP packets as framed datagrams.
+	// Peers of older versions leave it false and copy UDP packets as a raw stream.
+	Framed bool
+	// Optional entries keyed by type, see protocol.go.
+	Metadata map[byte][]byte
 }
 
-func proxyDial(dialer *corenet.Dialer, channel, network, remoteAddress string, tlsConfig *tls.Config) (net.Conn, error) {
-	conn, err := dialer.Dial(channel)
+// errorClass describes why the endpoint failed to serve a request.
+type errorClass int
+
+const (
+	errorClassGeneral errorClass = iota
+	errorClassConnectionRefused
+	errorClassHostUnreachable
+	errorClassNetworkUnreachable
+	errorClassTTLExpired
+	errorClassNotAllowed
+	errorClassDNSFailure
+	errorClassUnsupported
+)
+
+func (class errorClass) String() string {
+	switch class {
+	case errorClassConnectionRefused:
+		return "connection refused"
+	case errorClassHostUnreachable:
+		return "host unreachable"
+	case errorClassNetworkUnreachable:
+		return "network unreachable"
+	case errorClassTTLExpired:
+		return "ttl expired"
+	case errorClassNotAllowed:
+		return "not allowed"
+	case errorClassDNSFailure:
+		return "dns failure"
+	case errorClassUnsupported:
+		return "unsupported"
+	}
+	return "general failure"
+}
+
+// remoteError is the error reported by the endpoint.
+type remoteError struct {
+	Class   errorClass
+	Message string
+}
+
+func (err *remoteError) Error() string {
+	return fmt.Sprintf("remote error (%v): %s", err.Class, err.Message)
+}
+
+// classifyError maps a local dial or listen error to an errorClass.
+func classifyError(err error) errorClass {
+	var dnsErr *net.DNSError
+	var unknownNetworkErr net.UnknownNetworkError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errAccessDenied):
+		return errorClassNotAllowed
+	case errors.As(err, &dnsErr):
+		return errorClassDNSFailure
+	case errors.As(err, &unknownNetworkErr):
+		return errorClassUnsupported
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return errorClassConnectionRefused
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return errorClassHostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return errorClassNetworkUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errorClassTTLExpired
+	}
+	return errorClassGeneral
+}
+
+// errorClassOf returns the class reported by the endpoint if `err` is a remoteError, or classifies `err` as a local error.
+func errorClassOf(err error) errorClass {
+	var remoteErr *remoteError
+	if errors.As(err, &remoteErr) {
+		return remoteErr.Class
+	}
+	return classifyError(err)
+}
+
+// failureResponse builds the response reporting `err` to the client.
+func failureResponse(err error) response {
+	return response{Success: false, Payload: err.Error(), ErrorClass: classifyError(err)}
+}
+
+// proxyConn reports the local address of the endpoint's remote connection as its own local address.
+type proxyConn struct {
+	net.Conn
+	localAddr net.Addr
+}
+
+// LocalAddr returns the address the endpoint uses to reach the remote address.
+func (conn *proxyConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+// parseRemoteLocalAddr parses the address reported by the endpoint in `response.Payload`.
+func parseRemoteLocalAddr(network, payload string) (net.Addr, error) {
+	addrPort, err := netip.ParseAddrPort(payload)
 	if err != nil {
 		return nil, err
 	}
-	conn = tls.Client(conn, tlsConfig)
+	if strings.HasPrefix(network, "udp") {
+		return net.UDPAddrFromAddrPort(addrPort), nil
+	}
+	return net.TCPAddrFromAddrPort(addrPort), nil
+}
 
+// proxyBindConn is the connection returned by proxyDial for `bind` requests.
+// The endpoint sends a second response once a peer connects to the bound address.
+type proxyBindConn struct {
+	net.Conn
+	boundAddr    net.Addr
+	readResponse func() (response, error)
+}
+
+// BoundAddr returns the address the endpoint is listening on.
+func (conn *proxyBindConn) BoundAddr() net.Addr {
+	return conn.boundAddr
+}
+
+// AcceptPeer blocks until the endpoint accepts a peer, returns the address of the peer.
+func (conn *proxyBindConn) AcceptPeer() (net.Addr, error) {
+	resp, err := conn.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Success {
+		return nil, &remoteError{Class: resp.ErrorClass, Message: resp.Payload}
+	}
+	return parseRemoteLocalAddr("tcp", resp.Payload)
+}
+
+// legacyEndpointRetryInterval is how long a channel keeps using gob before trying the binary handshake again.
+const legacyEndpointRetryInterval = 10 * time.Minute
+
+var (
+	legacyEndpointMu sync.Mutex
+	legacyEndpoints  = map[string]time.Time{}
+)
+
+// verifiedEndpoints records the channels known to speak the binary handshake, only those receive optimistic requests.
+var verifiedEndpoints = map[string]bool{}
+
+func isVerifiedEndpoint(channel string) bool {
+	legacyEndpointMu.Lock()
+	defer legacyEndpointMu.Unlock()
+	return verifiedEndpoints[channel]
+}
+
+func markVerifiedEndpoint(channel string) {
+	legacyEndpointMu.Lock()
+	defer legacyEndpointMu.Unlock()
+	verifiedEndpoints[channel] = true
+}
+
+func isLegacyEndpoint(channel string) bool {
+	legacyEndpointMu.Lock()
+	defer legacyEndpointMu.Unlock()
+	return time.Now().Before(legacyEndpoints[channel])
+}
+
+func markLegacyEndpoint(channel string) {
+	legacyEndpointMu.Lock()
+	defer legacyEndpointMu.Unlock()
+	legacyEndpoints[channel] = time.Now().Add(legacyEndpointRetryInterval)
+	delete(verifiedEndpoints, channel)
+}
+
+// optimisticConn is returned before the endpoint confirms the request, the response is checked on the first Read.
+type optimisticConn struct {
+	net.Conn
+	once         sync.Once
+	readResponse func() (response, error)
+	err          error
+	// onLegacyPeer is called if the endpoint turns out to only speak gob, it can be nil.
+	onLegacyPeer func()
+}
+
+// LocalAddr returns an unspecified address as the real one is unknown before the response.
+func (conn *optimisticConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+}
+
+func (conn *optimisticConn) Read(p []byte) (int, error) {
+	conn.once.Do(func() {
+		resp, err := conn.readResponse()
+		if err == nil && !resp.Success {
+			err = &remoteError{Class: resp.ErrorClass, Message: resp.Payload}
+		}
+		if errors.Is(err, errLegacyPeer) && conn.onLegacyPeer != nil {
+			conn.onLegacyPeer()
+		}
+		conn.err = err
+	})
+	if conn.err != nil {
+		return 0, conn.err
+	}
+	return conn.Conn.Read(p)
+}
+
+// proxyDial connects to `remoteAddress` through the endpoint on `channel`.
+// If `optimistic` is true, TCP connections are returned before the endpoint confirms them once the endpoint is known
+// to support it, errors will be returned by the first Read instead.
+func proxyDial(dialer *corenet.Dialer, channel, network, remoteAddress string, tlsConfig *tls.Config, optimistic bool) (net.Conn, error) {
+	return proxyDialChannel(func() (net.Conn, error) {
+		conn, err := dialer.Dial(channel)
+		if err != nil {
+			return nil, err
+		}
+		return tls.Client(conn, tlsConfig), nil
+	}, channel, network, remoteAddress, optimistic)
+}
+
+// proxyDialChannel is proxyDial with `dial` opening a secured connection to the endpoint on `channel`.
+func proxyDialChannel(dial func() (net.Conn, error), channel, network, remoteAddress string, optimistic bool) (net.Conn, error) {
+	legacy := isLegacyEndpoint(channel)
+	optimistic = optimistic && !legacy && isVerifiedEndpoint(channel)
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	remoteConn, err := proxyHandshake(conn, network, remoteAddress, legacy, optimistic)
+	var remoteErr *remoteError
+	if !legacy && (err == nil || errors.As(err, &remoteErr)) {
+		markVerifiedEndpoint(channel)
+	}
+	if optimisticConn, ok := remoteConn.(*optimisticConn); ok {
+		// The request is already failed once the response reveals a legacy endpoint, only later dials use gob.
+		optimisticConn.onLegacyPeer = func() {
+			log.Printf("Endpoint `%s` only speaks the legacy handshake, later requests use gob", channel)
+			markLegacyEndpoint(channel)
+		}
+	}
+	if legacy || !errors.Is(err, errLegacyPeer) {
+		return remoteConn, err
+	}
+	log.Printf("Endpoint `%s` only speaks the legacy handshake, retrying with gob", channel)
+	markLegacyEndpoint(channel)
+	if conn, err = dial(); err != nil {
+		return nil, err
+	}
+	return proxyHandshake(conn, network, remoteAddress, true, false)
+}
+
+// proxyHandshake asks the endpoint behind `conn` to connect to `remoteAddress`. `conn` is closed on failure.
+// The legacy gob handshake is used if `legacy` is true.
+// If `optimistic` is true, TCP connections are returned without waiting for the response.
+func proxyHandshake(conn net.Conn, network, remoteAddress string, legacy, optimistic bool) (net.Conn, error) {
+	// DNS queries are exchanged as datagrams as well.
+	isDatagram := strings.HasPrefix(network, "udp") || network == "dns"
+	optimistic = optimistic && !legacy && strings.HasPrefix(network, "tcp")
 	handshakeSuccess := false
 	defer func() {
 		if !handshakeSuccess {
@@ -36,41 +296,186 @@ func proxyDial(dialer *corenet.Dialer, channel, network, remoteAddress string, t
 		}
 	}()
 
-	if err := gob.NewEncoder(conn).Encode(request{Method: network, Address: remoteAddress}); err != nil {
+	readResponse, err := sendProxyRequest(conn, request{Method: network, Address: remoteAddress, Framed: isDatagram, Optimistic: optimistic}, legacy)
+	if err != nil {
 		return nil, err
 	}
-	resp := response{}
-	if err := gob.NewDecoder(conn).Decode(&resp); err != nil {
+	if optimistic {
+		handshakeSuccess = true
+		return &optimisticConn{Conn: conn, readResponse: readResponse}, nil
+	}
+	resp, err := readResponse()
+	if err != nil {
 		return nil, err
 	}
 	if !resp.Success {
-		return nil, fmt.Errorf("remote error: %s", resp.Payload)
+		return nil, &remoteError{Class: resp.ErrorClass, Message: resp.Payload}
+	}
+	if network == "bind" {
+		boundAddr, err := parseRemoteLocalAddr("tcp", resp.Payload)
+		if err != nil {
+			return nil, err
+		}
+		handshakeSuccess = true
+		return &proxyBindConn{Conn: conn, boundAddr: boundAddr, readResponse: readResponse}, nil
 	}
 	handshakeSuccess = true
-	return conn, nil
+	if isDatagram && resp.Framed {
+		conn = newDatagramConn(conn)
+	}
+	localAddr, err := parseRemoteLocalAddr(network, resp.Payload)
+	if err != nil {
+		log.Printf("cannot parse the bound address `%s` from the endpoint: %v", resp.Payload, err)
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, localAddr: localAddr}, nil
+}
+
+// bindListenAddress returns the address to listen on for a bind request expecting a peer from `peerAddress`.
+// The listener is bound to the interface that routes to the peer so that the address is meaningful to the client.
+func bindListenAddress(peerAddress string) string {
+	host, _, err := net.SplitHostPort(peerAddress)
+	if err != nil {
+		return ":0"
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return ":0"
+	}
+	// Dialing UDP sends no packet, it only selects the outgoing interface.
+	probe, err := net.Dial("udp", net.JoinHostPort(host, "9"))
+	if err != nil {
+		return ":0"
+	}
+	defer probe.Close()
+	return net.JoinHostPort(probe.LocalAddr().(*net.UDPAddr).IP.String(), "0")
+}
+
+// serveBind listens on behalf of the client and splices the first accepted peer into `clientconn`.
+func serveBind(clientconn net.Conn, peer, peerAddress string, reply func(response) error) {
+	if endpointACL != nil {
+		ctx, cancelFn := context.WithTimeout(context.Background(), *socks5DialTimeout)
+		_, err := endpointACL.Resolve(ctx, peer, "bind", peerAddress)
+		cancelFn()
+		if err != nil {
+			reply(failureResponse(err))
+			return
+		}
+	}
+	listener, err := net.Listen("tcp", bindListenAddress(peerAddress))
+	if err != nil {
+		reply(failureResponse(err))
+		return
+	}
+	defer listener.Close()
+	if reply(response{Success: true, Payload: listener.Addr().String()}) != nil {
+		return
+	}
+	var expectedIP net.IP
+	if host, _, err := net.SplitHostPort(peerAddress); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			expectedIP = ip
+		}
+	}
+	ctx, cancelFn := context.WithTimeout(context.Background(), *socks5BindTimeout)
+	defer cancelFn()
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	var peerConn net.Conn
+	for peerConn == nil {
+		conn, err := listener.Accept()
+		if err != nil {
+			reply(response{Success: false, Payload: "no peer connected", ErrorClass: errorClassTTLExpired})
+			return
+		}
+		if expectedIP != nil && !conn.RemoteAddr().(*net.TCPAddr).IP.Equal(expectedIP) {
+			log.Printf("bind: rejected unexpected peer %s, expect %s", conn.RemoteAddr().String(), expectedIP.String())
+			conn.Close()
+			continue
+		}
+		peerConn = conn
+	}
+	defer peerConn.Close()
+	listener.Close()
+	if reply(response{Success: true, Payload: peerConn.RemoteAddr().String()}) != nil {
+		return
+	}
+	copyCtx, copyCancelFn := context.WithCancel(context.Background())
+	go func() { io.Copy(clientconn, peerConn); copyCancelFn() }()
+	go func() { io.Copy(peerConn, clientconn); copyCancelFn() }()
+	<-copyCtx.Done()
 }
 
-func handleProxyServer(listener net.Listener) error {
+// handleProxyServer serves the requests of peers accepted by `listener`. Reverse forwards connect to the callback
+// channels of peers with `reverseDialer`, they are refused if it is nil. Connections are drained by `tracker`.
+func handleProxyServer(listener net.Listener, reverseDialer func(peer, channel string) (net.Conn, error), tracker *connectionTracker) error {
 	log.Printf("Serving on address %s", listener.Addr().String())
+	tracker.TrackListener(listener)
+	defer tracker.UntrackListener(listener)
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
-		go func(clientconn net.Conn) {
-			defer clientconn.Close()
-			req := request{}
-			if gob.NewDecoder(clientconn).Decode(&req) != nil {
-				gob.NewEncoder(clientconn).Encode(response{Success: false, Payload: "invaild format"})
+		if !tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer tracker.Untrack(conn)
+			defer conn.Close()
+			peer, err := peerIdentity(conn)
+			if err != nil {
+				log.Printf("Cannot identify the client from %s: %v", conn.RemoteAddr().String(), err)
 				return
 			}
-			remoteConn, err := net.DialTimeout(req.Method, req.Address, *socks5DialTimeout)
+			clientconn, req, reply, err := acceptProxyRequest(conn)
 			if err != nil {
-				gob.NewEncoder(clientconn).Encode(response{Success: false, Payload: err.Error()})
+				if reply != nil {
+					reply(response{Success: false, Payload: "invaild format", ErrorClass: errorClassUnsupported})
+				}
+				return
+			}
+			log.Printf("[%s] %s %s", peer, req.Method, req.Address)
+			if req.Method == "bind" {
+				serveBind(clientconn, peer, req.Address, reply)
+				return
+			}
+			if req.Method == "udp-mux" {
+				serveUDPMux(clientconn, peer, reply)
+				return
+			}
+			if req.Method == "dns" {
+				serveDNS(clientconn, peer, reply)
+				return
+			}
+			if req.Method == "reverse" {
+				serveReverse(clientconn, peer, req, reply, reverseDialer, tracker)
+				return
+			}
+			remoteConn, err := dialRemote(endpointACL, peer, req.Method, req.Address)
+			if err != nil {
+				log.Printf("[%s] %s %s failed: %v", peer, req.Method, req.Address, err)
+				reply(failureResponse(err))
+				if req.Optimistic {
+					// Drains the early data, closing with unread data might reset the connection before the client reads the response.
+					clientconn.SetReadDeadline(time.Now().Add(*socks5DialTimeout))
+					io.Copy(io.Discard, clientconn)
+				}
 				return
 			}
 			defer remoteConn.Close()
-			if gob.NewEncoder(clientconn).Encode(response{Success: true, Payload: remoteConn.LocalAddr().String()}) != nil {
+			framed := req.Framed && strings.HasPrefix(req.Method, "udp")
+			if reply(response{Success: true, Payload: remoteConn.LocalAddr().String(), Framed: framed}) != nil {
+				return
+			}
+			if framed {
+				datagramClientConn := newDatagramConn(clientconn)
+				ctx, cancelFn := context.WithCancel(context.Background())
+				go func() { copyDatagrams(datagramClientConn, remoteConn); cancelFn() }()
+				go func() { copyDatagrams(remoteConn, datagramClientConn); cancelFn() }()
+				<-ctx.Done()
 				return
 			}
 			ctx, cancelFn := context.WithCancel(context.Background())
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func startProxyServer(t *testing.T) string {
+	return startReverseProxyServer(t, nil, newConnectionTracker())
+}
+
+// startReverseProxyServer starts a proxy server accepting reverse forwards with `reverseDialer`, drained by `tracker`.
+func startReverseProxyServer(t *testing.T, reverseDialer func(peer, channel string) (net.Conn, error), tracker *connectionTracker) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go handleProxyServer(listener, reverseDialer, tracker)
+	return listener.Addr().String()
+}
+
+func expectEcho(t *testing.T, conn net.Conn) {
+	message := []byte("hello clover3")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, message) {
+		t.Errorf("unexpected echo: %s", buf)
+	}
+}
+
+func TestHandshakeEncoding(t *testing.T) {
+	buf := new(bytes.Buffer)
+	req := request{Method: "udp-mux", Address: "example.com:53", Framed: true, Metadata: map[byte][]byte{7: []byte("value")}}
+	if err := encodeRequest(buf, req); err != nil {
+		t.Fatal(err)
+	}
+	decodedReq, err := decodeRequest(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(req, decodedReq) {
+		t.Errorf("request mismatch: %+v, expect %+v", decodedReq, req)
+	}
+
+	resp := response{Success: false, Payload: "refused", ErrorClass: errorClassConnectionRefused}
+	if err := encodeResponse(buf, resp); err != nil {
+		t.Fatal(err)
+	}
+	decodedResp, err := decodeResponse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resp, decodedResp) {
+		t.Errorf("response mismatch: %+v, expect %+v", decodedResp, resp)
+	}
+
+	if err := encodeRequest(buf, request{Method: "unknown"}); err == nil {
+		t.Error("expect an error on unsupported method")
+	}
+}
+
+func TestHandshakeWithEndpoint(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	proxyAddress := startProxyServer(t)
+
+	for _, legacy := range []bool{false, true} {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remoteConn, err := proxyHandshake(conn, "tcp", echoAddress, legacy, false)
+		if err != nil {
+			t.Fatalf("legacy = %v: %v", legacy, err)
+		}
+		expectEcho(t, remoteConn)
+		remoteConn.Close()
+	}
+}
+
+// startLegacyEndpoint starts a server behaving like endpoints that only understand gob.
+func startLegacyEndpoint(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		// Behaves like endpoints that only understand gob.
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			req := request{}
+			if gob.NewDecoder(conn).Decode(&req) != nil {
+				gob.NewEncoder(conn).Encode(response{Success: false, Payload: "invaild format"})
+			}
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestHandshakeWithLegacyEndpoint(t *testing.T) {
+	conn, err := net.Dial("tcp", startLegacyEndpoint(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxyHandshake(conn, "tcp", "127.0.0.1:1", false, false); !errors.Is(err, errLegacyPeer) {
+		t.Errorf("expect errLegacyPeer, got %v", err)
+	}
+}
+
+func TestOptimisticDialDowngradesLegacyEndpoint(t *testing.T) {
+	endpointAddress := startLegacyEndpoint(t)
+	channel := "legacy-" + t.Name()
+	t.Cleanup(func() {
+		legacyEndpointMu.Lock()
+		defer legacyEndpointMu.Unlock()
+		delete(legacyEndpoints, channel)
+		delete(verifiedEndpoints, channel)
+	})
+	// The endpoint was verified before it got downgraded.
+	markVerifiedEndpoint(channel)
+	dial := func() (net.Conn, error) { return net.Dial("tcp", endpointAddress) }
+
+	remoteConn, err := proxyDialChannel(dial, channel, "tcp", "127.0.0.1:1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteConn.Close()
+	if _, ok := remoteConn.(*optimisticConn); !ok {
+		t.Fatalf("expect an optimistic connection to a verified endpoint, got %T", remoteConn)
+	}
+	if _, err := remoteConn.Read(make([]byte, 1)); !errors.Is(err, errLegacyPeer) {
+		t.Errorf("expect errLegacyPeer, got %v", err)
+	}
+	if !isLegacyEndpoint(channel) || isVerifiedEndpoint(channel) {
+		t.Error("expect the endpoint to be recorded as legacy")
+	}
+
+	// Later dials use gob right away.
+	if _, err := proxyDialChannel(dial, channel, "tcp", "127.0.0.1:1", true); errors.Is(err, errLegacyPeer) {
+		t.Errorf("expect the gob handshake to be used, got %v", err)
+	}
+}
+
+func TestOptimisticHandshake(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	proxyAddress := startProxyServer(t)
+
+	conn, err := net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteConn, err := proxyHandshake(conn, "tcp", echoAddress, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, remoteConn)
+	remoteConn.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+
+	conn, err = net.Dial("tcp", proxyAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remoteConn, err = proxyHandshake(conn, "tcp", closedAddress, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remoteConn.Close()
+	if _, err := remoteConn.Write([]byte("early data")); err != nil {
+		t.Fatal(err)
+	}
+	var remoteErr *remoteError
+	if _, err := remoteConn.Read(make([]byte, 1)); !errors.As(err, &remoteErr) || remoteErr.Class != errorClassConnectionRefused {
+		t.Errorf("expect connection refused, got %v", err)
+	}
+}
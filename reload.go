@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xpy123993/corenet"
+)
+
+// On SIGHUP, or when watched files change, flags are loaded again from all sources into a mirror of cmdFlags.
+// Certificates are swapped for new handshakes, and local services whose settings changed are restarted.
+// Other flags, like the ones of the relay and endpoint services, only apply after a restart.
+
+// serviceStopTimeout is how long a reload waits for a stopped service to release its ports.
+const serviceStopTimeout = 5 * time.Second
+
+// reloadableFlags are the flags applied by reloads, see buildLocalServices.
+var reloadableFlags = map[string]bool{
+	"config": true, "tls-ca": true, "tls-cert": true, "tls-key": true, "revocation-list": true,
+	"socks5-list": true, "http-proxy-list": true, "dns-list": true, "transparent-list": true, "transparent-mode": true,
+	"forward": true, "forward-udp-timeout": true, "reverse-forward": true, "socks5-public": true,
+	"socks5-auth": true, "socks5-auth-file": true, "socks5-allow-users": true, "socks5-deny-users": true,
+	"route": true, "route-file": true, "route-channels": true, "channel-group-policy": true, "channel-health-interval": true,
+}
+
+// textValue holds the text of a flag value.
+type textValue struct {
+	text   string
+	isBool bool
+}
+
+func (value *textValue) String() string {
+	if value == nil {
+		return ""
+	}
+	return value.text
+}
+
+func (value *textValue) Set(text string) error {
+	value.text = text
+	return nil
+}
+
+func (value *textValue) IsBoolFlag() bool {
+	return value.isBool
+}
+
+// newFlagMirror returns a flag set with the flags of `flags` at their default values, holding values as text.
+// Flags can be loaded into it without changing the ones read by running services.
+func newFlagMirror(flags *flag.FlagSet) *flag.FlagSet {
+	mirror := flag.NewFlagSet(flags.Name(), flag.ContinueOnError)
+	mirror.SetOutput(io.Discard)
+	flags.VisitAll(func(f *flag.Flag) {
+		boolFlag, isBool := f.Value.(interface{ IsBoolFlag() bool })
+		mirror.Var(&textValue{text: f.DefValue, isBool: isBool && boolFlag.IsBoolFlag()}, f.Name, f.Usage)
+	})
+	return mirror
+}
+
+// flagChanged returns true if `text` is a different value from the one of `f`.
+func flagChanged(f *flag.Flag, text string) bool {
+	getter, ok := f.Value.(flag.Getter)
+	if !ok {
+		return f.Value.String() != text
+	}
+	switch current := getter.Get().(type) {
+	case bool:
+		value, err := strconv.ParseBool(text)
+		return err != nil || value != current
+	case int:
+		value, err := strconv.Atoi(text)
+		return err != nil || value != current
+	case time.Duration:
+		value, err := time.ParseDuration(text)
+		return err != nil || value != current
+	}
+	return f.Value.String() != text
+}
+
+// settingsKey joins `values` into a key, see buildLocalServices.
+func settingsKey(values ...string) string {
+	return fmt.Sprintf("%q", values)
+}
+
+// fileDigest returns the digest of the file at `filePath`, so that keys change with the content of the file.
+func fileDigest(filePath string) string {
+	if len(filePath) == 0 {
+		return ""
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// localService is a client side service, identified by `Key`.
+type localService struct {
+	Name string
+	Key  string
+	// The network and address pairs the service listens on, checked before the service is started.
+	Addresses [][2]string
+	Serve     func(ctx context.Context) error
+}
+
+type runningService struct {
+	service  localService
+	cancelFn context.CancelFunc
+	done     chan struct{}
+	// If true, the process exits when the service fails, see Apply.
+	exitOnFailure bool
+}
+
+// checkListenAddress returns an error if `address` cannot be listened on with `network`.
+func checkListenAddress(network, address string) error {
+	if strings.HasPrefix(network, "udp") {
+		conn, err := net.ListenPacket(network, address)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return listener.Close()
+}
+
+// serviceManager runs local services and restarts the ones changed by reloads.
+type serviceManager struct {
+	mu      sync.Mutex
+	running map[string]*runningService
+}
+
+var localServices = &serviceManager{running: map[string]*runningService{}}
+
+// Apply stops the running services not in `services` and starts the ones not running yet. The addresses of the
+// services to start are checked first, nothing changes if any of them cannot be listened on.
+// If `exitOnFailure` is true, a started service exiting by itself signals exitSig. Otherwise it is only logged,
+// so that services started by reloads never stop the process.
+func (manager *serviceManager) Apply(services []localService, exitOnFailure bool) (started, stopped int, err error) {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+	expected := map[string]bool{}
+	for _, service := range services {
+		expected[service.Key] = true
+	}
+	// Addresses of the services to stop are released before new services start.
+	released := map[[2]string]bool{}
+	for key, running := range manager.running {
+		if expected[key] {
+			continue
+		}
+		for _, address := range running.service.Addresses {
+			released[address] = true
+		}
+	}
+	for _, service := range services {
+		if _, exist := manager.running[service.Key]; exist {
+			continue
+		}
+		for _, address := range service.Addresses {
+			if released[address] {
+				continue
+			}
+			if err := checkListenAddress(address[0], address[1]); err != nil {
+				return 0, 0, fmt.Errorf("%s cannot listen on %s: %v", service.Name, address[1], err)
+			}
+		}
+	}
+	for key, service := range manager.running {
+		if expected[key] {
+			continue
+		}
+		service.cancelFn()
+		select {
+		case <-service.done:
+		case <-time.After(serviceStopTimeout):
+			log.Printf("WARNING: service %s does not stop in %v", key, serviceStopTimeout)
+		}
+		delete(manager.running, key)
+		stopped++
+	}
+	for _, service := range services {
+		if _, exist := manager.running[service.Key]; exist {
+			continue
+		}
+		ctx, cancelFn := context.WithCancel(context.Background())
+		running := &runningService{service: service, cancelFn: cancelFn, done: make(chan struct{}), exitOnFailure: exitOnFailure}
+		manager.running[service.Key] = running
+		started++
+		go func(service localService) {
+			err := service.Serve(ctx)
+			close(running.done)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("%s exited with error: %v", service.Name, err)
+			manager.mu.Lock()
+			if manager.running[service.Key] == running {
+				delete(manager.running, service.Key)
+			}
+			manager.mu.Unlock()
+			if !running.exitOnFailure {
+				return
+			}
+			select {
+			case exitSig <- struct{}{}:
+			default:
+			}
+		}(service)
+	}
+	return started, stopped, nil
+}
+
+var (
+	reloadMu sync.Mutex
+	// loadedFlags are the flags loaded last, cmdFlags until the first reload.
+	loadedFlags = cmdFlags
+)
+
+// reload loads flags again with the command arguments `args` and applies them, the running state is kept if anything fails.
+// Services started by reloads are not restarted if they fail later, the next reload starts them again.
+func reload(args []string, dialer *corenet.Dialer, certName string) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	flags := newFlagMirror(cmdFlags)
+	if err := loadFlags(flags, args); err != nil {
+		return fmt.Errorf("cannot load configs: %v", err)
+	}
+	value := func(name string) string { return flags.Lookup(name).Value.String() }
+	tlsConfig, err := loadTLSConfig(value("tls-ca"), value("tls-cert"), value("tls-key"), value("revocation-list"))
+	if err != nil {
+		return err
+	}
+	// Peers verify the channels they connect to by name, so the name cannot change.
+	if name, err := getServerName(tlsConfig.Certificates[0].Certificate[0]); err != nil || name != certName {
+		return fmt.Errorf("the certificate must keep the name `%s`", certName)
+	}
+	services, err := buildLocalServices(flags, dialer, certName)
+	if err != nil {
+		return err
+	}
+	started, stopped, err := localServices.Apply(services, false)
+	if err != nil {
+		return err
+	}
+	activeTLSConfig.Store(tlsConfig)
+	cmdFlags.VisitAll(func(f *flag.Flag) {
+		if !reloadableFlags[f.Name] && flagChanged(f, value(f.Name)) {
+			log.Printf("WARNING: flag `%s` changed, restart to apply it", f.Name)
+		}
+	})
+	loadedFlags = flags
+	log.Printf("Reloaded, %d services started and %d stopped", started, stopped)
+	return nil
+}
+
+// watchedFiles returns the files reloads read, which are checked for changes by watchReload.
+func watchedFiles() []string {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	value := func(name string) string { return loadedFlags.Lookup(name).Value.String() }
+	files := []string{configFilePath(loadedFlags), value("socks5-auth-file"), value("route-file"), value("revocation-list")}
+	if len(value("tls-ca")) > 0 || len(value("tls-cert")) > 0 || len(value("tls-key")) > 0 {
+		return append(files, value("tls-ca"), value("tls-cert"), value("tls-key"))
+	}
+	return append(files, os.Getenv("CLOVER_CA"), os.Getenv("CLOVER_CRT"), os.Getenv("CLOVER_KEY"))
+}
+
+// fileVersions returns the modification time and size of `files`, ignoring empty paths.
+func fileVersions(files []string) map[string]string {
+	versions := map[string]string{}
+	for _, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			versions[file] = err.Error()
+			continue
+		}
+		versions[file] = fmt.Sprintf("%v %d", info.ModTime(), info.Size())
+	}
+	return versions
+}
+
+// watchReload calls `reload` on every signal from `signals`, and when the watched files change if `interval` is positive.
+func watchReload(signals <-chan os.Signal, interval time.Duration, reload func() error) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	versions := fileVersions(watchedFiles())
+	for {
+		select {
+		case sig, ok := <-signals:
+			if !ok {
+				return
+			}
+			log.Printf("Received signal: %v, reloading", sig)
+		case <-ticks:
+			current := fileVersions(watchedFiles())
+			if fmt.Sprint(current) == fmt.Sprint(versions) {
+				continue
+			}
+			log.Printf("Watched files changed, reloading")
+		}
+		if err := reload(); err != nil {
+			log.Printf("Reload failed: %v", err)
+		}
+		versions = fileVersions(watchedFiles())
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFlagMirror(t *testing.T) {
+	mirror := newFlagMirror(cmdFlags)
+	if err := mirror.Parse([]string{"-socks5-public", "-socks5-dial-timeout", "10s", "-endpoint-channel-direct-port=7"}); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]bool{
+		"socks5-public":                true,
+		"socks5-dial-timeout":          false,
+		"endpoint-channel-direct-port": true,
+		"socks5-list":                  false,
+	} {
+		if changed := flagChanged(cmdFlags.Lookup(name), mirror.Lookup(name).Value.String()); changed != expected {
+			t.Errorf("flag %s: changed is %v, expect %v", name, changed, expected)
+		}
+	}
+}
+
+func TestServiceManagerApply(t *testing.T) {
+	manager := &serviceManager{running: map[string]*runningService{}}
+	listeners := make(chan string, 10)
+	service := func(key string) localService {
+		return localService{Name: key, Key: key, Serve: func(ctx context.Context) error {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			listeners <- key
+			<-ctx.Done()
+			return listener.Close()
+		}}
+	}
+	if started, stopped, err := manager.Apply([]localService{service("a"), service("b")}, false); err != nil || started != 2 || stopped != 0 {
+		t.Errorf("expect 2 services started, got %d started and %d stopped (%v)", started, stopped, err)
+	}
+	stopping := manager.running["a"]
+	if started, stopped, err := manager.Apply([]localService{service("b"), service("c")}, false); err != nil || started != 1 || stopped != 1 {
+		t.Errorf("expect 1 service started and 1 stopped, got %d and %d (%v)", started, stopped, err)
+	}
+	select {
+	case <-stopping.done:
+	default:
+		t.Error("expect the removed service to be stopped when Apply returns")
+	}
+	serving := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		select {
+		case key := <-listeners:
+			serving[key] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("services do not start")
+		}
+	}
+	if len(serving) != 3 {
+		t.Errorf("expect every service to be started once, got %v", serving)
+	}
+	manager.Apply(nil, false)
+	if len(manager.running) != 0 {
+		t.Errorf("expect no running service, got %d", len(manager.running))
+	}
+}
+
+func TestServiceManagerApplyAddressInUse(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	manager := &serviceManager{running: map[string]*runningService{}}
+	serving := func(key, address string) localService {
+		return localService{Name: key, Key: key, Addresses: [][2]string{{"tcp", address}}, Serve: func(ctx context.Context) error {
+			<-ctx.Done()
+			return nil
+		}}
+	}
+	freeAddress := unusedAddress(t, "tcp")
+	if _, _, err := manager.Apply([]localService{serving("a", freeAddress)}, false); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Apply(nil, false)
+
+	// The reload is refused as a whole, the running service is kept.
+	if _, _, err := manager.Apply([]localService{serving("b", occupied.Addr().String())}, false); err == nil {
+		t.Error("expect an error if an address is in use")
+	}
+	if _, running := manager.running["a"]; !running || len(manager.running) != 1 {
+		t.Errorf("expect the running services to be kept, got %v", manager.running)
+	}
+	// Addresses of the services being replaced are released first.
+	if _, _, err := manager.Apply([]localService{serving("c", freeAddress)}, false); err != nil {
+		t.Errorf("expect the address of a stopped service to be reusable, got %v", err)
+	}
+}
+
+// writeTestIdentity creates a CA and the certificate of `name` in `dir`, then copies them to `caFile`, `certFile` and `keyFile`.
+func writeTestIdentity(t *testing.T, dir, name, caFile, certFile, keyFile string) []byte {
+	issueTestNodes(t, dir, name)
+	var rawCert []byte
+	for source, target := range map[string]string{"ca.crt": caFile, name + ".crt": certFile, name + ".key": keyFile} {
+		data, err := os.ReadFile(filepath.Join(dir, source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(target, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if target == certFile {
+			block, _ := pem.Decode(data)
+			rawCert = block.Bytes
+		}
+	}
+	return rawCert
+}
+
+func TestReloadRotatesCertificate(t *testing.T) {
+	savedActive, savedTemplate, savedLoaded := activeTLSConfig.Load(), templateTLSConfig, loadedFlags
+	t.Cleanup(func() {
+		activeTLSConfig.Store(savedActive)
+		templateTLSConfig, loadedFlags = savedTemplate, savedLoaded
+	})
+	liveDir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(liveDir, "ca.crt"), filepath.Join(liveDir, "cert.crt"), filepath.Join(liveDir, "cert.key")
+	args := []string{"-tls-ca", caFile, "-tls-cert", certFile, "-tls-key", keyFile}
+	oldCert := writeTestIdentity(t, t.TempDir(), "host-a", caFile, certFile, keyFile)
+	tlsConfig, err := loadTLSConfig(caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeTLSConfig.Store(tlsConfig)
+	templateTLSConfig = reloadableTLSConfig(tlsConfig)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", templateTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// Channel dials clone activeTLSConfig, so that the CA pools of servers and clients are rotated.
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), channelTLSConfig("host-a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	oldConn := dial()
+	defer oldConn.Close()
+	expectEcho(t, oldConn)
+	if !bytes.Equal(oldConn.ConnectionState().PeerCertificates[0].Raw, oldCert) {
+		t.Fatal("expect the initial certificate")
+	}
+
+	// A new CA and a new certificate replace the files.
+	newCert := writeTestIdentity(t, t.TempDir(), "host-a", caFile, certFile, keyFile)
+	if err := reload(args, nil, "host-a"); err != nil {
+		t.Fatal(err)
+	}
+	newConn := dial()
+	defer newConn.Close()
+	expectEcho(t, newConn)
+	if !bytes.Equal(newConn.ConnectionState().PeerCertificates[0].Raw, newCert) {
+		t.Error("expect new handshakes to present the reloaded certificate")
+	}
+	// The connection established before the reload keeps working.
+	expectEcho(t, oldConn)
+
+	// The certificate cannot be renamed by a reload.
+	writeTestIdentity(t, t.TempDir(), "host-b", caFile, certFile, keyFile)
+	if err := reload(args, nil, "host-a"); err == nil {
+		t.Error("expect a reload renaming the certificate to fail")
+	}
+}
+
+// issueTestRelay issues a certificate of `name` valid for 127.0.0.1 with the CA in `dir`, and writes it to
+// `certFile` and `keyFile`.
+func issueTestRelay(t *testing.T, dir, name, certFile, keyFile string) []byte {
+	caCert, _, caKey, err := loadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialNumber, err := newSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawCert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(certFile)
+	os.Remove(keyFile)
+	files, err := keyPairFiles(certFile, keyFile, rawCert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writePEMFiles(files...); err != nil {
+		t.Fatal(err)
+	}
+	return rawCert
+}
+
+func TestReloadDialRelayByIP(t *testing.T) {
+	savedActive, savedTemplate, savedLoaded := activeTLSConfig.Load(), templateTLSConfig, loadedFlags
+	t.Cleanup(func() {
+		activeTLSConfig.Store(savedActive)
+		templateTLSConfig, loadedFlags = savedTemplate, savedLoaded
+	})
+	caDir, liveDir := t.TempDir(), t.TempDir()
+	if err := initCA(caDir, "test-ca", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	caFile, certFile, keyFile := filepath.Join(caDir, "ca.crt"), filepath.Join(liveDir, "relay.crt"), filepath.Join(liveDir, "relay.key")
+	args := []string{"-tls-ca", caFile, "-tls-cert", certFile, "-tls-key", keyFile}
+	issueTestRelay(t, caDir, "relay", certFile, keyFile)
+	tlsConfig, err := loadTLSConfig(caFile, certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	activeTLSConfig.Store(tlsConfig)
+	templateTLSConfig = reloadableTLSConfig(tlsConfig)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", templateTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	// Relays are dialed with templateTLSConfig, addressed by IP the handshake has no server name.
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), templateTLSConfig.Clone())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	conn := dial()
+	defer conn.Close()
+	expectEcho(t, conn)
+
+	// The certificate is renewed by the same CA.
+	newCert := issueTestRelay(t, caDir, "relay", certFile, keyFile)
+	if err := reload(args, nil, "relay"); err != nil {
+		t.Fatal(err)
+	}
+	newConn := dial()
+	defer newConn.Close()
+	expectEcho(t, newConn)
+	if !bytes.Equal(newConn.ConnectionState().PeerCertificates[0].Raw, newCert) {
+		t.Error("expect the relay to present the reloaded certificate")
+	}
+}
+
+func TestSettingsKey(t *testing.T) {
+	if settingsKey("a,b", "c") == settingsKey("a", "b,c") {
+		t.Error("expect keys of different values to differ")
+	}
+	if fileDigest("") != "" {
+		t.Error("expect an empty digest without a file")
+	}
+}
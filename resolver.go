@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// IP families the endpoint resolver can be restricted to or prefer.
+const (
+	ipFamilyAny        = "any"
+	ipFamilyIPv4       = "ipv4"
+	ipFamilyIPv6       = "ipv6"
+	ipFamilyPreferIPv4 = "prefer-ipv4"
+	ipFamilyPreferIPv6 = "prefer-ipv6"
+)
+
+// endpointResolver resolves and dials destinations on behalf of clients.
+type endpointResolver struct {
+	// Name servers, the system ones are used if empty.
+	servers []string
+	// If true, queries are sent over TCP only.
+	forceTCP bool
+	// Static addresses of names, checked before name servers.
+	hosts    map[string][]netip.Addr
+	family   string
+	resolver *net.Resolver
+	// The delay before racing the next address, sequential dialing if not positive.
+	fallbackDelay time.Duration
+	nextServer    uint32
+}
+
+// endpointDNS is the resolver of the endpoint service, set by main.
+var endpointDNS = &endpointResolver{family: ipFamilyAny, resolver: net.DefaultResolver, fallbackDelay: 300 * time.Millisecond}
+
+// parseNameServers parses name servers splitted by `,`, the port is 53 if omitted.
+func parseNameServers(list string) ([]string, error) {
+	servers := []string{}
+	for _, server := range strings.Split(list, ",") {
+		if server = strings.TrimSpace(server); len(server) == 0 {
+			continue
+		}
+		if ip, err := netip.ParseAddr(server); err == nil {
+			server = netip.AddrPortFrom(ip, 53).String()
+		}
+		if _, err := netip.ParseAddrPort(server); err != nil {
+			return nil, fmt.Errorf("invalid name server `%s`, expect an IP address with optional port", server)
+		}
+		servers = append(servers, server)
+	}
+	return servers, nil
+}
+
+// addHost maps `name` to `ip`.
+func (resolver *endpointResolver) addHost(name, ip string) error {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return fmt.Errorf("invalid address `%s` of `%s`", ip, name)
+	}
+	name = normalizeDomain(name)
+	resolver.hosts[name] = append(resolver.hosts[name], addr.Unmap())
+	return nil
+}
+
+// loadHostsFile reads names in the format of /etc/hosts.
+func (resolver *endpointResolver) loadHostsFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = readRuleLines(file, func(line string) error {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("expect an address followed by names")
+		}
+		for _, name := range fields[1:] {
+			if err := resolver.addHost(name, fields[0]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", filePath, err)
+	}
+	return nil
+}
+
+// newEndpointResolver creates a resolver using `servers` splitted by `,`, and `hosts` like `name=ip,ip;name=ip`
+// followed by the names in `hostsFile`.
+func newEndpointResolver(servers string, forceTCP bool, hosts, hostsFile, family string, fallbackDelay time.Duration) (*endpointResolver, error) {
+	switch family {
+	case ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6:
+	default:
+		return nil, fmt.Errorf("unknown ip family `%s`, expect %s, %s, %s, %s or %s", family, ipFamilyAny, ipFamilyIPv4, ipFamilyIPv6, ipFamilyPreferIPv4, ipFamilyPreferIPv6)
+	}
+	nameServers, err := parseNameServers(servers)
+	if err != nil {
+		return nil, err
+	}
+	resolver := &endpointResolver{
+		servers:       nameServers,
+		forceTCP:      forceTCP,
+		hosts:         map[string][]netip.Addr{},
+		family:        family,
+		fallbackDelay: fallbackDelay,
+		resolver:      net.DefaultResolver,
+	}
+	for _, entry := range strings.Split(hosts, ";") {
+		if entry = strings.TrimSpace(entry); len(entry) == 0 {
+			continue
+		}
+		name, ips, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid host entry `%s`, expect name=ip", entry)
+		}
+		for _, ip := range strings.Split(ips, ",") {
+			if err := resolver.addHost(name, strings.TrimSpace(ip)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(hostsFile) > 0 {
+		if err := resolver.loadHostsFile(hostsFile); err != nil {
+			return nil, err
+		}
+	}
+	if len(nameServers) > 0 || forceTCP {
+		resolver.resolver = &net.Resolver{PreferGo: true, Dial: resolver.dialNameServer}
+	}
+	return resolver, nil
+}
+
+// NameServers returns the name servers to forward queries to.
+func (resolver *endpointResolver) NameServers() []string {
+	if len(resolver.servers) > 0 {
+		return resolver.servers
+	}
+	return systemNameServers()
+}
+
+// dialNameServer replaces the address picked by the Go resolver with the configured name servers, in turns.
+// A stream connection is returned if TCP is forced, which makes the Go resolver frame queries for TCP.
+func (resolver *endpointResolver) dialNameServer(ctx context.Context, network, _ string) (net.Conn, error) {
+	if resolver.forceTCP {
+		network = "tcp"
+	}
+	servers := resolver.NameServers()
+	offset := int(atomic.AddUint32(&resolver.nextServer, 1))
+	dialer := net.Dialer{}
+	var lastErr error
+	for i := range servers {
+		conn, err := dialer.DialContext(ctx, network, servers[(offset+i)%len(servers)])
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+// Hosts returns the static addresses of `name`.
+func (resolver *endpointResolver) Hosts(name string) []netip.Addr {
+	return resolver.hosts[normalizeDomain(name)]
+}
+
+// sortByFamily drops or reorders `addrs` by the configured family, the order within a family is kept.
+func (resolver *endpointResolver) sortByFamily(addrs []netip.Addr) []netip.Addr {
+	result := []netip.Addr{}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if (resolver.family == ipFamilyIPv4 && !addr.Is4()) || (resolver.family == ipFamilyIPv6 && !addr.Is6()) {
+			continue
+		}
+		result = append(result, addr)
+	}
+	switch resolver.family {
+	case ipFamilyPreferIPv4:
+		sort.SliceStable(result, func(i, j int) bool { return result[i].Is4() && !result[j].Is4() })
+	case ipFamilyPreferIPv6:
+		sort.SliceStable(result, func(i, j int) bool { return result[i].Is6() && !result[j].Is6() })
+	}
+	return result
+}
+
+// LookupNetIP resolves `host` with the static names first, then the name servers. IP literals are returned as they
+// are, the configured family applies to them as well.
+func (resolver *endpointResolver) LookupNetIP(ctx context.Context, host string) ([]netip.Addr, error) {
+	addrs := resolver.Hosts(host)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{ip}
+	} else if len(addrs) == 0 {
+		var err error
+		if addrs, err = resolver.resolver.LookupNetIP(ctx, "ip", host); err != nil {
+			return nil, err
+		}
+	}
+	if addrs = resolver.sortByFamily(addrs); len(addrs) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("no %s address", resolver.family), Name: host, IsNotFound: true}
+	}
+	return addrs, nil
+}
+
+// interleaveFamilies reorders `addresses` to alternate between families, starting with the family of the first one.
+func interleaveFamilies(addresses []string) []string {
+	primary, secondary := []string{}, []string{}
+	isIPv4 := func(address string) bool {
+		addrPort, err := netip.ParseAddrPort(address)
+		return err == nil && addrPort.Addr().Is4()
+	}
+	for _, address := range addresses {
+		if isIPv4(address) == isIPv4(addresses[0]) {
+			primary = append(primary, address)
+		} else {
+			secondary = append(secondary, address)
+		}
+	}
+	result := []string{}
+	for len(primary) > 0 || len(secondary) > 0 {
+		if len(primary) > 0 {
+			result, primary = append(result, primary[0]), primary[1:]
+		}
+		if len(secondary) > 0 {
+			result, secondary = append(result, secondary[0]), secondary[1:]
+		}
+	}
+	return result
+}
+
+// Dial connects to the first reachable address in `addresses`. TCP connections are raced like Happy Eyeballs
+// (RFC 8305): attempts start `fallbackDelay` apart, or right after the previous one fails, and the first wins.
+func (resolver *endpointResolver) Dial(ctx context.Context, network string, addresses []string) (net.Conn, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no address to dial")
+	}
+	dialer := net.Dialer{}
+	if !strings.HasPrefix(network, "tcp") || resolver.fallbackDelay <= 0 || len(addresses) == 1 {
+		var err error
+		for _, address := range addresses {
+			var conn net.Conn
+			if conn, err = dialer.DialContext(ctx, network, address); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+
+	raceContext, cancelFn := context.WithCancel(ctx)
+	defer cancelFn()
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan dialResult)
+	pending := 0
+	addresses = interleaveFamilies(addresses)
+	var lastErr error
+	for len(addresses) > 0 || pending > 0 {
+		var timer <-chan time.Time
+		if len(addresses) > 0 {
+			address := addresses[0]
+			addresses = addresses[1:]
+			pending++
+			go func() {
+				conn, err := dialer.DialContext(raceContext, network, address)
+				select {
+				case results <- dialResult{conn: conn, err: err}:
+				case <-raceContext.Done():
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}()
+			timer = time.After(resolver.fallbackDelay)
+		}
+		for waiting := true; waiting && pending > 0; {
+			select {
+			case result := <-results:
+				pending--
+				if result.err == nil {
+					return result.conn, nil
+				}
+				lastErr = result.err
+				// Starts the next attempt right away.
+				waiting = false
+			case <-timer:
+				waiting = false
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEndpointResolverHosts(t *testing.T) {
+	hostsFile := filepath.Join(t.TempDir(), "hosts")
+	if err := os.WriteFile(hostsFile, []byte("# static names\n10.0.0.2 db.internal db # primary\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	resolver, err := newEndpointResolver("1.1.1.1, [2606:4700::1111]:5353", false, "git.internal=fd00::1,10.0.0.1", hostsFile, ipFamilyPreferIPv4, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers := resolver.NameServers(); !reflect.DeepEqual(servers, []string{"1.1.1.1:53", "[2606:4700::1111]:5353"}) {
+		t.Errorf("unexpected name servers: %v", servers)
+	}
+	ctx := context.Background()
+	for name, expected := range map[string][]netip.Addr{
+		"git.internal.": {netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("fd00::1")},
+		"DB":            {netip.MustParseAddr("10.0.0.2")},
+	} {
+		addrs, err := resolver.LookupNetIP(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(addrs, expected) {
+			t.Errorf("%s resolved to %v, expect %v", name, addrs, expected)
+		}
+	}
+
+	resolver.family = ipFamilyIPv6
+	if _, err := resolver.LookupNetIP(ctx, "db.internal"); err == nil {
+		t.Error("expect an error if no address is in the family")
+	}
+	if _, err := resolver.LookupNetIP(ctx, "10.0.0.3"); err == nil {
+		t.Error("expect an error if an IP literal is not in the family")
+	}
+	if addrs, err := resolver.LookupNetIP(ctx, "fd00::2"); err != nil || len(addrs) != 1 {
+		t.Errorf("expect an IP literal in the family to be kept, got %v (%v)", addrs, err)
+	}
+
+	for _, config := range [][]string{{"1.1.1.1:port", "", "any"}, {"", "name", "any"}, {"", "name=ip", "any"}, {"", "", "ipv5"}} {
+		if _, err := newEndpointResolver(config[0], false, config[1], "", config[2], 0); err == nil {
+			t.Errorf("expect an error on %v", config)
+		}
+	}
+}
+
+func TestInterleaveFamilies(t *testing.T) {
+	addresses := interleaveFamilies([]string{"[::1]:80", "[::2]:80", "[::3]:80", "10.0.0.1:80", "10.0.0.2:80"})
+	expected := []string{"[::1]:80", "10.0.0.1:80", "[::2]:80", "10.0.0.2:80", "[::3]:80"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("got %v, expect %v", addresses, expected)
+	}
+}
+
+func TestHappyEyeballsDial(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	closedAddress := unusedAddress(t, "tcp")
+	resolver := &endpointResolver{fallbackDelay: 50 * time.Millisecond}
+
+	// TEST-NET-1 is never routed, the attempt either hangs or fails right away.
+	start := time.Now()
+	ctx, cancelFn := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelFn()
+	conn, err := resolver.Dial(ctx, "tcp", []string{"192.0.2.1:80", closedAddress, echoAddress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect the reachable address to win quickly, took %v", elapsed)
+	}
+	expectEcho(t, conn)
+
+	if _, err := resolver.Dial(ctx, "tcp", []string{closedAddress}); err == nil {
+		t.Error("expect an error if no address is reachable")
+	}
+}
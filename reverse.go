@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reverse forwards work like `ssh -R`. The client serves a callback channel on the relay and registers it with
+// the endpoint by a `reverse` request, the endpoint then listens on a port and dials the callback channel for each
+// accepted connection. The client connects those to a local address, so that the service behind the client is
+// reachable from the endpoint host, and from other peers proxying through the endpoint.
+//
+// The registration stays alive as long as the request connection, the endpoint stops listening once it is closed.
+
+// reverseForwardRetryInterval is the delay before the client registers a reverse forward again.
+const reverseForwardRetryInterval = 5 * time.Second
+
+// reverseForwardRule describes a port on the endpoint host forwarded to a local address of the client.
+type reverseForwardRule struct {
+	Channel      string
+	EndpointPort string
+	LocalAddress string
+}
+
+// parseReverseForwardRules parses `[channel]:[endpoint port]:[local host]:[local port]` splitted by `,`.
+func parseReverseForwardRules(list string) ([]reverseForwardRule, error) {
+	rules, err := parseForwardRules(list)
+	if err != nil {
+		return nil, err
+	}
+	reverseRules := []reverseForwardRule{}
+	for _, rule := range rules {
+		if rule.Network != "tcp" {
+			return nil, fmt.Errorf("reverse forwards only support tcp")
+		}
+		reverseRules = append(reverseRules, reverseForwardRule{Channel: rule.Channel, EndpointPort: rule.LocalPort, LocalAddress: rule.RemoteAddress})
+	}
+	return reverseRules, nil
+}
+
+// reverseListenAddress returns the address the endpoint listens on for a reverse forward requesting `address`.
+// Only the port is taken from the request, the host is loopback unless `public` is true.
+func reverseListenAddress(address string, public bool) (netip.AddrPort, error) {
+	_, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port `%s`", rawPort)
+	}
+	if public {
+		return netip.AddrPortFrom(netip.IPv6Unspecified(), uint16(port)), nil
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), uint16(port)), nil
+}
+
+// serveReverse listens on behalf of `peer` and connects every accepted connection to the callback channel in `req`
+// with `dialChannel`. Reverse forwards are refused if `dialChannel` is nil. The listener and the connections are
+// drained by `tracker`.
+func serveReverse(clientconn net.Conn, peer string, req request, reply func(response) error, dialChannel func(peer, channel string) (net.Conn, error), tracker *connectionTracker) {
+	callbackChannel := string(req.Metadata[handshakeMetadataCallbackChannel])
+	if dialChannel == nil {
+		reply(response{Success: false, Payload: "reverse forwards are not enabled on the endpoint", ErrorClass: errorClassUnsupported})
+		return
+	}
+	// The callback channel must belong to the client, so that the endpoint never connects to anyone else on its behalf.
+	if !strings.HasPrefix(callbackChannel, peer+"@") {
+		reply(response{Success: false, Payload: fmt.Sprintf("callback channel `%s` does not belong to `%s`", callbackChannel, peer), ErrorClass: errorClassNotAllowed})
+		return
+	}
+	listenAddress, err := reverseListenAddress(req.Address, *reversePublicPorts)
+	if err != nil {
+		reply(failureResponse(err))
+		return
+	}
+	if !endpointACL.Allowed(peer, "reverse", "", listenAddress.Addr(), listenAddress.Port()) {
+		reply(failureResponse(fmt.Errorf("%w: reverse %s for `%s`", errAccessDenied, listenAddress.String(), peer)))
+		return
+	}
+	listener, err := net.Listen("tcp", listenAddress.String())
+	if err != nil {
+		reply(failureResponse(err))
+		return
+	}
+	defer listener.Close()
+	if reply(response{Success: true, Payload: listener.Addr().String()}) != nil {
+		return
+	}
+	tracker.TrackListener(listener)
+	defer tracker.UntrackListener(listener)
+	go func() {
+		// The client sends nothing after the request, the read returns once the registration is closed.
+		io.Copy(io.Discard, clientconn)
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("[%s] reverse %s closed", peer, listener.Addr().String())
+			return
+		}
+		if !tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer tracker.Untrack(conn)
+			defer conn.Close()
+			callbackConn, err := dialChannel(peer, callbackChannel)
+			if err != nil {
+				log.Printf("[%s] reverse %s: cannot reach `%s`: %v", peer, listener.Addr().String(), callbackChannel, err)
+				return
+			}
+			defer callbackConn.Close()
+			ctx, cancelFn := context.WithCancel(context.Background())
+			go func() { io.Copy(conn, callbackConn); cancelFn() }()
+			go func() { io.Copy(callbackConn, conn); cancelFn() }()
+			<-ctx.Done()
+		}(conn)
+	}
+}
+
+// registerReverseForward asks the endpoint behind `conn` to listen on `endpointAddress` and connect accepted
+// connections to `callbackChannel`. Returns the address the endpoint listens on. `conn` is closed on failure.
+func registerReverseForward(conn net.Conn, endpointAddress, callbackChannel string) (net.Addr, error) {
+	readResponse, err := sendProxyRequest(conn, request{
+		Method:   "reverse",
+		Address:  endpointAddress,
+		Metadata: map[byte][]byte{handshakeMetadataCallbackChannel: []byte(callbackChannel)},
+	}, false)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp, err := readResponse()
+	if err != nil {
+		conn.Close()
+		if err == errLegacyPeer {
+			return nil, fmt.Errorf("endpoint does not support reverse forwards")
+		}
+		return nil, err
+	}
+	if !resp.Success {
+		conn.Close()
+		return nil, &remoteError{Class: resp.ErrorClass, Message: resp.Payload}
+	}
+	boundAddr, err := parseRemoteLocalAddr("tcp", resp.Payload)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return boundAddr, nil
+}
+
+// StartReverseForward keeps a reverse forward registered through `Register`, and connects the connections accepted
+// on the callback channel `listener` to `LocalAddress`. If `EndpointName` is not empty, connections from other peers are rejected.
+// The listener and the connections are drained by `Tracker`, the registration is closed once the listener is.
+func StartReverseForward(RuntimeContext context.Context, Register func() (net.Conn, net.Addr, error), listener net.Listener, EndpointName, LocalAddress string, Tracker *connectionTracker) error {
+	serveContext, cancelFn := context.WithCancel(RuntimeContext)
+	defer cancelFn()
+	go func() {
+		<-serveContext.Done()
+		listener.Close()
+	}()
+	go func() {
+		for serveContext.Err() == nil {
+			conn, boundAddr, err := Register()
+			if err != nil {
+				log.Printf("Cannot register reverse forward to `%s`: %v", LocalAddress, err)
+			} else {
+				log.Printf("Reverse forward `%s` -> `%s` is registered", boundAddr.String(), LocalAddress)
+				closed := make(chan struct{})
+				go func() {
+					select {
+					case <-serveContext.Done():
+						conn.Close()
+					case <-closed:
+					}
+				}()
+				io.Copy(io.Discard, conn)
+				close(closed)
+				conn.Close()
+				log.Printf("Reverse forward `%s` -> `%s` is closed", boundAddr.String(), LocalAddress)
+			}
+			select {
+			case <-serveContext.Done():
+			case <-time.After(reverseForwardRetryInterval):
+			}
+		}
+	}()
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if RuntimeContext.Err() != nil {
+				return RuntimeContext.Err()
+			}
+			return err
+		}
+		if !Tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer Tracker.Untrack(conn)
+			defer conn.Close()
+			peer, err := peerIdentity(conn)
+			if err != nil {
+				log.Printf("Cannot identify the reverse forward peer from %s: %v", conn.RemoteAddr().String(), err)
+				return
+			}
+			if len(EndpointName) > 0 && peer != EndpointName {
+				log.Printf("Reverse forward: rejected connection from `%s`, expect `%s`", peer, EndpointName)
+				return
+			}
+			localConn, err := net.DialTimeout("tcp", LocalAddress, *socks5DialTimeout)
+			if err != nil {
+				log.Printf("Reverse forward to %s failed: %v", LocalAddress, err)
+				return
+			}
+			defer localConn.Close()
+			ctx, cancelFn := context.WithCancel(RuntimeContext)
+			go func() { io.Copy(conn, localConn); cancelFn() }()
+			go func() { io.Copy(localConn, conn); cancelFn() }()
+			<-ctx.Done()
+		}(conn)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// startTestReverseForward registers a reverse forward to an echo server with a proxy server draining with `tracker`.
+// Returns the address the proxy server listens on for the forward.
+func startTestReverseForward(t *testing.T, tracker *connectionTracker) string {
+	echoAddress := startEchoServer(t)
+	endpointAddress := unusedAddress(t, "tcp")
+
+	callbackListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyAddress := startReverseProxyServer(t, func(peer, channel string) (net.Conn, error) {
+		if channel != "@test" {
+			return nil, fmt.Errorf("unexpected callback channel `%s`", channel)
+		}
+		return net.Dial("tcp", callbackListener.Addr().String())
+	}, tracker)
+
+	register := func() (net.Conn, net.Addr, error) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			return nil, nil, err
+		}
+		boundAddr, err := registerReverseForward(conn, endpointAddress, "@test")
+		return conn, boundAddr, err
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	t.Cleanup(cancelFn)
+	go StartReverseForward(ctx, register, callbackListener, "", echoAddress, newConnectionTracker())
+	return endpointAddress
+}
+
+func TestReverseForward(t *testing.T) {
+	conn := dialDrainableForward(t, startTestReverseForward(t, newConnectionTracker()))
+	defer conn.Close()
+	expectEcho(t, conn)
+}
+
+func TestReverseForwardDisabled(t *testing.T) {
+	conn, err := net.Dial("tcp", startProxyServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerReverseForward(conn, unusedAddress(t, "tcp"), "@test")
+	var remoteErr *remoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Class != errorClassUnsupported {
+		t.Errorf("expect the registration to be refused, got %v", err)
+	}
+}
+
+func TestReverseForwardForeignChannel(t *testing.T) {
+	conn, err := net.Dial("tcp", startReverseProxyServer(t, func(peer, channel string) (net.Conn, error) {
+		return nil, errors.New("unexpected dial")
+	}, newConnectionTracker()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = registerReverseForward(conn, unusedAddress(t, "tcp"), "someone-else@test")
+	var remoteErr *remoteError
+	if !errors.As(err, &remoteErr) || remoteErr.Class != errorClassNotAllowed {
+		t.Errorf("expect the registration to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// A revocation list rejects peer certificates issued by the shared CA before they expire. The file is either
+// CRLs issued by the CA, in PEM or DER, or a deny list with one entry per line:
+//
+//	serial=0a:1b:2c    the serial number in hex, colons are optional.
+//	name=host-a        the certificate name, see getCertificateName.
+//
+// Lines starting with `#` are ignored. CRLs are verified when the list is loaded, a CRL not signed by a trusted CA
+// or past its next update is refused, so that a stale CRL is noticed instead of silently accepting revoked peers.
+// A CRL going stale after loading rejects the peers it covers until the list is reloaded.
+
+// revocationList holds the revoked serial numbers and names.
+type revocationList struct {
+	serials map[string]bool
+	names   map[string]bool
+	crls    []*x509.RevocationList
+	// Serial numbers revoked by each CRL, in the same order as `crls`.
+	crlSerials []map[string]bool
+	// now returns the time CRLs are checked against.
+	now func() time.Time
+}
+
+func parseSerialNumber(value string) (*big.Int, error) {
+	serial, ok := new(big.Int).SetString(strings.ReplaceAll(value, ":", ""), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid serial number `%s`", value)
+	}
+	return serial, nil
+}
+
+// addCRL adds the CRL in `der` after verifying it was signed by one of `issuers` and is not stale.
+func (list *revocationList) addCRL(der []byte, issuers []*x509.Certificate) error {
+	crl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return err
+	}
+	if err := verifyCRL(crl, issuers, list.now()); err != nil {
+		return err
+	}
+	serials := map[string]bool{}
+	for _, revoked := range crl.RevokedCertificates {
+		serials[revoked.SerialNumber.String()] = true
+	}
+	list.crls = append(list.crls, crl)
+	list.crlSerials = append(list.crlSerials, serials)
+	return nil
+}
+
+// checkCRLFreshness returns an error if `crl` is past its next update at `now`.
+func checkCRLFreshness(crl *x509.RevocationList, now time.Time) error {
+	if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+		return fmt.Errorf("CRL of `%s` is stale, its next update was due at %s", crl.Issuer, crl.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verifyCRL returns an error if `crl` is stale at `now` or not signed by one of `issuers`.
+func verifyCRL(crl *x509.RevocationList, issuers []*x509.Certificate, now time.Time) error {
+	if err := checkCRLFreshness(crl, now); err != nil {
+		return err
+	}
+	for _, issuer := range issuers {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := crl.CheckSignatureFrom(issuer); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("CRL of `%s` is not signed by a trusted CA", crl.Issuer)
+}
+
+// loadRevocationList reads the revocation list at `filePath`, CRLs must be signed by one of `issuers`.
+func loadRevocationList(filePath string, issuers []*x509.Certificate) (*revocationList, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	list := &revocationList{serials: map[string]bool{}, names: map[string]bool{}, now: time.Now}
+	switch {
+	case bytes.Contains(data, []byte("-----BEGIN X509 CRL-----")):
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type != "X509 CRL" {
+				continue
+			}
+			if err := list.addCRL(block.Bytes, issuers); err != nil {
+				return nil, fmt.Errorf("%s: %v", filePath, err)
+			}
+		}
+		if len(list.crls) == 0 {
+			return nil, fmt.Errorf("%s: no CRL found", filePath)
+		}
+	case len(data) > 0 && data[0] == 0x30:
+		// A DER encoded CRL starts with an ASN.1 sequence.
+		if err := list.addCRL(data, issuers); err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+	default:
+		err = readRuleLines(bytes.NewReader(data), func(line string) error {
+			key, value, found := strings.Cut(line, "=")
+			value = strings.TrimSpace(value)
+			if !found || len(value) == 0 {
+				return fmt.Errorf("invalid entry `%s`, expect serial=<hex> or name=<name>", line)
+			}
+			switch strings.TrimSpace(key) {
+			case "serial":
+				serial, err := parseSerialNumber(value)
+				if err != nil {
+					return err
+				}
+				list.serials[serial.String()] = true
+			case "name":
+				list.names[value] = true
+			default:
+				return fmt.Errorf("unknown key `%s`, expect serial or name", key)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	return list, nil
+}
+
+// checkCertificate returns an error if `cert` is revoked. The CRLs issued by `issuer` apply, it is nil if unknown,
+// then CRLs are not checked. A stale CRL rejects every certificate it applies to.
+func (list *revocationList) checkCertificate(cert, issuer *x509.Certificate) error {
+	if list.serials[cert.SerialNumber.String()] || list.names[getCertificateName(cert)] {
+		return fmt.Errorf("certificate of `%s` (serial %x) is revoked", getCertificateName(cert), cert.SerialNumber)
+	}
+	if issuer == nil {
+		return nil
+	}
+	for i, crl := range list.crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if err := checkCRLFreshness(crl, list.now()); err != nil {
+			return fmt.Errorf("cannot check the certificate of `%s`: %v", getCertificateName(cert), err)
+		}
+		if list.crlSerials[i][cert.SerialNumber.String()] {
+			return fmt.Errorf("certificate of `%s` (serial %x) is revoked by CRL", getCertificateName(cert), cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// VerifyConnection rejects revoked peers. Unlike VerifyPeerCertificate, it also runs on resumed sessions.
+func (list *revocationList) VerifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		var issuer *x509.Certificate
+		if len(chain) > 1 {
+			issuer = chain[1]
+		}
+		if err := list.checkCertificate(chain[0], issuer); err != nil {
+			return err
+		}
+	}
+	if len(state.VerifiedChains) == 0 && len(state.PeerCertificates) > 0 {
+		return list.checkCertificate(state.PeerCertificates[0], nil)
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueTestNodes creates a CA in `dir` and issues the nodes `names` with it.
+func issueTestNodes(t *testing.T, dir string, names ...string) {
+	if err := initCA(dir, "test-ca", 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := issueCertificate(dir, name, time.Hour, dir, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handshakeWithRevocations connects `client` to `server`, which rejects peers in `revocationFile`.
+// Returns the error of the server.
+func handshakeWithRevocations(t *testing.T, dir, server, client, revocationFile string) error {
+	serverConfig, err := loadTLSConfig(filepath.Join(dir, "ca.crt"), filepath.Join(dir, server+".crt"), filepath.Join(dir, server+".key"), revocationFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, _, err := getTLSConfigFromFiles(filepath.Join(dir, "ca.crt"), filepath.Join(dir, client+".crt"), filepath.Join(dir, client+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig.ServerName = server
+	// Unlike net.Pipe, TCP buffers the alert of a rejecting server while the client is still writing.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- tls.Server(conn, serverConfig).Handshake()
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tls.Client(conn, clientConfig).Handshake()
+	// Unblocks the server if the client gave up first.
+	conn.Close()
+	return <-result
+}
+
+func TestRevocationDenyList(t *testing.T) {
+	dir := t.TempDir()
+	issueTestNodes(t, dir, "host-a", "host-b", "host-c")
+	rawCert, err := os.ReadFile(filepath.Join(dir, "host-c.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(rawCert)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revocationFile := filepath.Join(dir, "revoked.txt")
+	content := "# leaked\nname=host-b\nserial=" + cert.SerialNumber.Text(16) + "\n"
+	if err := os.WriteFile(revocationFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handshakeWithRevocations(t, dir, "host-a", "host-b", revocationFile); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("expect host-b to be rejected by name, got %v", err)
+	}
+	if err := handshakeWithRevocations(t, dir, "host-a", "host-c", revocationFile); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("expect host-c to be rejected by serial, got %v", err)
+	}
+	if err := handshakeWithRevocations(t, dir, "host-b", "host-a", ""); err != nil {
+		t.Errorf("expect host-a to be accepted without a revocation list, got %v", err)
+	}
+
+	if err := os.WriteFile(revocationFile, []byte("fingerprint=00"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadRevocationList(revocationFile, nil); err == nil {
+		t.Error("expect an error on unknown entries")
+	}
+}
+
+func TestRevocationCRL(t *testing.T) {
+	dir := t.TempDir()
+	issueTestNodes(t, dir, "host-a", "host-b", "host-c")
+	caCert, _, caKey, err := loadCA(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(dir, "host-b.crt"), filepath.Join(dir, "host-b.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	createCRL := func(nextUpdate time.Time, issuer *x509.Certificate, key crypto.Signer) []byte {
+		rawCRL, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:     big.NewInt(1),
+			ThisUpdate: nextUpdate.Add(-2 * time.Hour),
+			NextUpdate: nextUpdate,
+			RevokedCertificates: []pkix.RevokedCertificate{
+				{SerialNumber: revokedCert.SerialNumber, RevocationTime: time.Now()},
+			},
+		}, issuer, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rawCRL
+	}
+	rawCRL := createCRL(time.Now().Add(time.Hour), caCert, caKey.(crypto.Signer))
+	revocationFile := filepath.Join(dir, "ca.crl")
+	writeCRL := func(data []byte) {
+		if err := os.WriteFile(revocationFile, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeCRL(pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: rawCRL}))
+
+	if err := handshakeWithRevocations(t, dir, "host-a", "host-b", revocationFile); err == nil || !strings.Contains(err.Error(), "revoked by CRL") {
+		t.Errorf("expect host-b to be rejected by the CRL, got %v", err)
+	}
+	if err := handshakeWithRevocations(t, dir, "host-a", "host-c", revocationFile); err != nil {
+		t.Errorf("expect host-c to be accepted, got %v", err)
+	}
+
+	// A DER encoded CRL is accepted as well.
+	writeCRL(rawCRL)
+	if err := handshakeWithRevocations(t, dir, "host-a", "host-b", revocationFile); err == nil || !strings.Contains(err.Error(), "revoked by CRL") {
+		t.Errorf("expect host-b to be rejected by the DER CRL, got %v", err)
+	}
+
+	caCerts := []*x509.Certificate{caCert}
+	// A CRL going stale after loading rejects the peers it covers.
+	list, err := loadRevocationList(revocationFile, caCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair, err = tls.LoadX509KeyPair(filepath.Join(dir, "host-c.crt"), filepath.Join(dir, "host-c.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	validCert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{validCert, caCert}}}
+	if err := list.VerifyConnection(state); err != nil {
+		t.Errorf("expect host-c to be accepted by a fresh CRL, got %v", err)
+	}
+	list.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := list.VerifyConnection(state); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("expect host-c to be rejected once the CRL is stale, got %v", err)
+	}
+
+	writeCRL(createCRL(time.Now().Add(-time.Minute), caCert, caKey.(crypto.Signer)))
+	if _, err := loadRevocationList(revocationFile, caCerts); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("expect a stale CRL to be refused, got %v", err)
+	}
+	otherDir := t.TempDir()
+	if err := initCA(otherDir, "test-ca", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	otherCert, _, otherKey, err := loadCA(otherDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeCRL(createCRL(time.Now().Add(time.Hour), otherCert, otherKey.(crypto.Signer)))
+	if _, err := loadRevocationList(revocationFile, caCerts); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("expect a CRL of another CA to be refused, got %v", err)
+	}
+	writeCRL([]byte("-----BEGIN X509 CRL-----\ntruncated\n"))
+	if _, err := loadRevocationList(revocationFile, caCerts); err == nil {
+		t.Error("expect an error if no CRL can be parsed")
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Routing rules decide where local proxy services send each request, the first matching rule wins.
+// A rule looks like `office domain=corp.example.com cidr=10.0.0.0/8 port=443`. The first field is the target:
+// a channel, `direct` to connect from this host, or `reject` to refuse the request. Other fields are the same as
+// access control rules except `peer`. Requests matching no rule go to the channel of the local port.
+//
+// Domains are never resolved locally so that they do not leak, cidr fields only match requests for IP addresses.
+
+const (
+	routeTargetDirect = "direct"
+	routeTargetReject = "reject"
+)
+
+type routeRule struct {
+	target string
+	accessRule
+}
+
+// routingTable picks the target of requests received by local proxy services.
+type routingTable struct {
+	rules []routeRule
+}
+
+func parseRouteRule(line string) (routeRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return routeRule{}, fmt.Errorf("empty rule")
+	}
+	rule, err := parseRuleFields(fields[1:])
+	if err != nil {
+		return routeRule{}, err
+	}
+	if len(rule.peers) > 0 {
+		return routeRule{}, fmt.Errorf("peer is not supported in routing rules")
+	}
+	return routeRule{target: fields[0], accessRule: rule}, nil
+}
+
+// LoadRules appends the rules read from `reader`, one per line. Empty lines and lines starting with `#` are ignored.
+func (table *routingTable) LoadRules(reader io.Reader) error {
+	return readRuleLines(reader, func(line string) error {
+		rule, err := parseRouteRule(line)
+		if err != nil {
+			return err
+		}
+		table.rules = append(table.rules, rule)
+		return nil
+	})
+}
+
+// Targets returns the channels used by the rules.
+func (table *routingTable) Targets() []string {
+	targets := []string{}
+	for _, rule := range table.rules {
+		if rule.target != routeTargetDirect && rule.target != routeTargetReject {
+			targets = append(targets, rule.target)
+		}
+	}
+	return targets
+}
+
+// CheckTargets returns an error if a channel used by the rules is not in `channels`, so that typos are found on loading
+// instead of becoming channel names. Members of channel groups are checked one by one.
+func (table *routingTable) CheckTargets(channels map[string]bool) error {
+	for _, target := range table.Targets() {
+		for _, channel := range strings.Split(target, "|") {
+			if !channels[strings.TrimSpace(channel)] {
+				return fmt.Errorf("unknown route target `%s`, expect %s, %s or a channel in route-channels or of a local service", channel, routeTargetDirect, routeTargetReject)
+			}
+		}
+	}
+	return nil
+}
+
+// RoutesUDPTo returns true if every rule that might match UDP requests sends them to `channel`.
+func (table *routingTable) RoutesUDPTo(channel string) bool {
+	for _, rule := range table.rules {
+		if rule.target == channel {
+			continue
+		}
+		if len(rule.networks) == 0 {
+			return false
+		}
+		for _, network := range rule.networks {
+			if network == "udp" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Route returns the target of the first rule matching the request, or an empty string if no rule matches.
+func (table *routingTable) Route(network, address string) string {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	port, _ := strconv.ParseUint(rawPort, 10, 16)
+	domain := host
+	ip, err := netip.ParseAddr(host)
+	if err == nil {
+		domain = ""
+	}
+	network, domain = normalizeNetwork(network), normalizeDomain(domain)
+	for _, rule := range table.rules {
+		if rule.match("", network, domain, ip, uint16(port)) {
+			return rule.target
+		}
+	}
+	return ""
+}
+
+// loadRoutingTable builds the table from inline rules splitted by `;` and the rule file.
+// Returns nil if no rule is configured.
+func loadRoutingTable(inlineRules, filePath string) (*routingTable, error) {
+	table := &routingTable{}
+	if len(filePath) > 0 {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if err := table.LoadRules(file); err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+	}
+	if err := table.LoadRules(strings.NewReader(strings.ReplaceAll(inlineRules, ";", "\n"))); err != nil {
+		return nil, fmt.Errorf("inline rules: %v", err)
+	}
+	if len(table.rules) == 0 {
+		return nil, nil
+	}
+	return table, nil
+}
+
+// routeDialer returns a dialer sending each request to the target picked by `table`, or to `defaultChannel`.
+// `channelDialer` creates the dialer of a channel.
+func routeDialer(table *routingTable, defaultChannel string, channelDialer func(channel string) (func(network, address string) (net.Conn, error), error)) (func(network, address string) (net.Conn, error), error) {
+	dialers := map[string]func(network, address string) (net.Conn, error){}
+	for _, target := range append([]string{defaultChannel}, table.Targets()...) {
+		if _, exist := dialers[target]; exist {
+			continue
+		}
+		dialer, err := channelDialer(target)
+		if err != nil {
+			return nil, err
+		}
+		dialers[target] = dialer
+	}
+	routesUDPToDefault := table.RoutesUDPTo(defaultChannel)
+	return func(network, address string) (net.Conn, error) {
+		// A multiplexed UDP tunnel carries packets to every destination. It is only used if the rules send all UDP
+		// traffic to the default channel, otherwise clients fall back to a tunnel per destination, which can be routed.
+		if network == "udp-mux" {
+			if routesUDPToDefault {
+				return dialers[defaultChannel](network, address)
+			}
+			return nil, net.UnknownNetworkError(network)
+		}
+		switch target := table.Route(network, address); target {
+		case "":
+			return dialers[defaultChannel](network, address)
+		case routeTargetDirect:
+			return net.DialTimeout(network, address, *socks5DialTimeout)
+		case routeTargetReject:
+			return nil, fmt.Errorf("%w: %s %s is rejected by routing rules", errAccessDenied, network, address)
+		default:
+			return dialers[target](network, address)
+		}
+	}, nil
+}
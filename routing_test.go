@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRoutingTable(t *testing.T) {
+	listFile := filepath.Join(t.TempDir(), "corp.txt")
+	if err := os.WriteFile(listFile, []byte("# corporate domains\ncorp.example.com\nintranet.example.org\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	table, err := loadRoutingTable("office domain=@"+listFile+"; direct cidr=private; reject port=25; home network=udp", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testCase := range []struct {
+		network, address, expected string
+	}{
+		{"tcp", "wiki.corp.example.com:443", "office"},
+		{"tcp", "intranet.example.org:80", "office"},
+		{"tcp", "10.1.2.3:22", routeTargetDirect},
+		{"tcp", "mail.example.com:25", routeTargetReject},
+		{"udp", "8.8.8.8:53", "home"},
+		// Domains are not resolved, so cidr rules do not apply to them.
+		{"tcp", "localhost:22", ""},
+		{"tcp", "example.com:443", ""},
+	} {
+		if target := table.Route(testCase.network, testCase.address); target != testCase.expected {
+			t.Errorf("%s %s is routed to `%s`, expect `%s`", testCase.network, testCase.address, target, testCase.expected)
+		}
+	}
+
+	if table, err := loadRoutingTable("", ""); err != nil || table != nil {
+		t.Errorf("expect no table without rules, got %v, %v", table, err)
+	}
+	for _, rules := range []string{"office peer=alice", "office color=red", "office domain=@/nonexistent"} {
+		if _, err := loadRoutingTable(rules, ""); err == nil {
+			t.Errorf("expect an error on `%s`", rules)
+		}
+	}
+}
+
+func TestRouteDialer(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	table, err := loadRoutingTable("reject port=25; direct cidr=loopback port=1-1023; office domain=corp.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed := []string{}
+	dial, err := routeDialer(table, "home", func(channel string) (func(network, address string) (net.Conn, error), error) {
+		return func(network, address string) (net.Conn, error) {
+			dialed = append(dialed, channel)
+			return net.Dial(network, echoAddress)
+		}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dial("tcp", echoAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEcho(t, conn)
+	conn.Close()
+	if conn, err = dial("tcp", "git.corp.example.com:22"); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(dialed) != 2 || dialed[0] != "home" || dialed[1] != "office" {
+		t.Errorf("unexpected channels: %v", dialed)
+	}
+
+	_, err = dial("tcp", "127.0.0.1:25")
+	if !errors.Is(err, errAccessDenied) || socks5ReplyCode(err) != socks5ReplyNotAllowed {
+		t.Errorf("expect the request to be rejected, got %v", err)
+	}
+	if _, err := dial("udp-mux", "0.0.0.0:0"); socks5ReplyCode(err) != socks5ReplyCommandNotSupported {
+		t.Errorf("expect udp-mux to be unsupported, got %v", err)
+	}
+
+	// udp-mux goes to the default channel if no rule sends UDP elsewhere.
+	table, err = loadRoutingTable("office network=tcp domain=corp.example.com; home network=udp port=53", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialed = nil
+	if dial, err = routeDialer(table, "home", func(channel string) (func(network, address string) (net.Conn, error), error) {
+		return func(network, address string) (net.Conn, error) {
+			dialed = append(dialed, channel)
+			return net.Dial("tcp", echoAddress)
+		}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = dial("udp-mux", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(dialed) != 1 || dialed[0] != "home" {
+		t.Errorf("expect udp-mux to go to the default channel, got %v", dialed)
+	}
+}
+
+func TestRouteTargets(t *testing.T) {
+	table, err := loadRoutingTable("office domain=corp.example.com; a|b port=22; direct cidr=private", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.CheckTargets(map[string]bool{"office": true, "a": true, "b": true}); err != nil {
+		t.Error(err)
+	}
+	if err := table.CheckTargets(map[string]bool{"office": true, "a": true}); err == nil {
+		t.Error("expect an error on an unknown member of a group")
+	}
+
+	flags := newFlagMirror(cmdFlags)
+	if err := flags.Parse([]string{"-socks5-list", "home:0", "-route", "ofice domain=corp.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildLocalServices(flags, nil, "host-a"); err == nil {
+		t.Error("expect an error on a target that is not a known channel")
+	}
+	flags.Set("route-channels", "ofice")
+	if _, err := buildLocalServices(flags, nil, "host-a"); err != nil {
+		t.Errorf("expect targets in route-channels to be accepted, got %v", err)
+	}
+}
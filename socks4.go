@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+// Reply codes defined in the SOCKS4 protocol.
+const (
+	socks4ReplyGranted  byte = 90
+	socks4ReplyRejected byte = 91
+)
+
+// readNullTerminated reads a string terminated by a zero byte, up to 255 bytes.
+func readNullTerminated(reader *bufio.Reader) (string, error) {
+	data := []byte{}
+	for len(data) < 256 {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(data), nil
+		}
+		data = append(data, b)
+	}
+	return "", fmt.Errorf("string too long")
+}
+
+// readSocks4Request parses a SOCKS4 or SOCKS4a request, returns the command and the requested address.
+func readSocks4Request(reader *bufio.Reader) (byte, string, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(reader, head); err != nil {
+		return 0, "", err
+	}
+	if head[0] != 4 {
+		return 0, "", fmt.Errorf("unsupported socks version: %d", head[0])
+	}
+	port := binary.BigEndian.Uint16(head[2:4])
+	// The user ID is ignored, SOCKS4 carries no password to verify it.
+	if _, err := readNullTerminated(reader); err != nil {
+		return 0, "", err
+	}
+	host := net.IP(head[4:8]).String()
+	// SOCKS4a: an address of 0.0.0.x (x != 0) means the hostname follows.
+	if head[4] == 0 && head[5] == 0 && head[6] == 0 && head[7] != 0 {
+		hostname, err := readNullTerminated(reader)
+		if err != nil {
+			return 0, "", err
+		}
+		host = hostname
+	}
+	return head[1], net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func (session *ClientSession) replySocks4(code byte) error {
+	_, err := session.Conn.Write([]byte{0, code, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveSocks4 serves a SOCKS4 or SOCKS4a CONNECT request read from `reader`.
+// Requests are rejected if credentials are configured, as SOCKS4 cannot authenticate.
+func (session *ClientSession) serveSocks4(RuntimeContext context.Context, reader *bufio.Reader, Dialer func(network, address string) (net.Conn, error)) {
+	command, remoteAddress, err := readSocks4Request(reader)
+	if err != nil {
+		log.Printf("failed to read socks4 request: %v", err)
+		return
+	}
+	if !session.Credentials.Empty() {
+		log.Printf("rejected socks4 request to %s: authentication is required", remoteAddress)
+		session.replySocks4(socks4ReplyRejected)
+		return
+	}
+	if command != 1 {
+		session.replySocks4(socks4ReplyRejected)
+		return
+	}
+	remoteConn, err := Dialer("tcp", remoteAddress)
+	if err != nil {
+		log.Printf("socks4 request to %s failed: %v", remoteAddress, err)
+		session.replySocks4(socks4ReplyRejected)
+		return
+	}
+	defer remoteConn.Close()
+	if session.replySocks4(socks4ReplyGranted) != nil {
+		return
+	}
+	ctx, cancelFn := context.WithCancel(RuntimeContext)
+	go func() { io.Copy(session.Conn, remoteConn); cancelFn() }()
+	go func() { io.Copy(remoteConn, session.Conn); cancelFn() }()
+	<-ctx.Done()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -48,6 +50,39 @@ func writeIPAndPort(Conn io.Writer, Addr net.Addr) error {
 	return nil
 }
 
+// Reply codes defined in RFC 1928.
+const (
+	socks5ReplyGeneralFailure          byte = 1
+	socks5ReplyNotAllowed              byte = 2
+	socks5ReplyNetworkUnreachable      byte = 3
+	socks5ReplyHostUnreachable         byte = 4
+	socks5ReplyConnectionRefused       byte = 5
+	socks5ReplyTTLExpired              byte = 6
+	socks5ReplyCommandNotSupported     byte = 7
+	socks5ReplyAddressTypeNotSupported byte = 8
+)
+
+var errUnsupportedAddressType = errors.New("unsupported address type")
+
+// socks5ReplyCode maps the error returned by the dialer to a socks5 reply code.
+func socks5ReplyCode(err error) byte {
+	switch errorClassOf(err) {
+	case errorClassConnectionRefused:
+		return socks5ReplyConnectionRefused
+	case errorClassHostUnreachable, errorClassDNSFailure:
+		return socks5ReplyHostUnreachable
+	case errorClassNetworkUnreachable:
+		return socks5ReplyNetworkUnreachable
+	case errorClassTTLExpired:
+		return socks5ReplyTTLExpired
+	case errorClassNotAllowed:
+		return socks5ReplyNotAllowed
+	case errorClassUnsupported:
+		return socks5ReplyCommandNotSupported
+	}
+	return socks5ReplyGeneralFailure
+}
+
 func readProxyAddress(conn io.Reader) (string, error) {
 	singleByte := make([]byte, 1)
 	target := ""
@@ -76,6 +111,8 @@ func readProxyAddress(conn io.Reader) (string, error) {
 			return "", err
 		}
 		target = net.IP(ipbuf).String()
+	default:
+		return "", errUnsupportedAddressType
 	}
 	portByte := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portByte); err != nil {
@@ -87,21 +124,72 @@ func readProxyAddress(conn io.Reader) (string, error) {
 // ClientSession abtracts all the operations on a client connection.
 type ClientSession struct {
 	Conn net.Conn
+	// If not empty, clients must authenticate with username/password (RFC 1929).
+	Credentials *Socks5Credentials
 }
 
-// socks5auth initiates the first handshake with authentication (no auth).
+// socks5auth initiates the first handshake with authentication.
+// Username/password is required if `Credentials` is not empty, otherwise no auth is selected.
 func (session *ClientSession) socks5auth() error {
 	singleByte := make([]byte, 1)
-	if _, err := session.Conn.Read(singleByte); err != nil || singleByte[0] != 5 {
+	if _, err := session.Conn.Read(singleByte); err != nil {
 		return err
 	}
+	if singleByte[0] != 5 {
+		return fmt.Errorf("unsupported socks version: %d", singleByte[0])
+	}
 	if _, err := session.Conn.Read(singleByte); err != nil {
 		return err
 	}
-	if _, err := io.ReadFull(session.Conn, make([]byte, singleByte[0])); err != nil {
+	methods := make([]byte, singleByte[0])
+	if _, err := io.ReadFull(session.Conn, methods); err != nil {
 		return err
 	}
-	if _, err := session.Conn.Write([]byte{5, 0}); err != nil {
+	expectedMethod := byte(0)
+	if !session.Credentials.Empty() {
+		expectedMethod = 2
+	}
+	if bytes.IndexByte(methods, expectedMethod) < 0 {
+		session.Conn.Write([]byte{5, 0xff})
+		return fmt.Errorf("no acceptable methods in %v", methods)
+	}
+	if _, err := session.Conn.Write([]byte{5, expectedMethod}); err != nil {
+		return err
+	}
+	if expectedMethod == 2 {
+		return session.verifyUserPassword()
+	}
+	return nil
+}
+
+// verifyUserPassword runs the username/password sub-negotiation defined in RFC 1929.
+func (session *ClientSession) verifyUserPassword() error {
+	singleByte := make([]byte, 1)
+	if _, err := io.ReadFull(session.Conn, singleByte); err != nil {
+		return err
+	}
+	if singleByte[0] != 1 {
+		return fmt.Errorf("unsupported auth version: %d", singleByte[0])
+	}
+	if _, err := io.ReadFull(session.Conn, singleByte); err != nil {
+		return err
+	}
+	username := make([]byte, singleByte[0])
+	if _, err := io.ReadFull(session.Conn, username); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(session.Conn, singleByte); err != nil {
+		return err
+	}
+	password := make([]byte, singleByte[0])
+	if _, err := io.ReadFull(session.Conn, password); err != nil {
+		return err
+	}
+	if !session.Credentials.Verify(string(username), string(password)) {
+		session.Conn.Write([]byte{1, 1})
+		return fmt.Errorf("authentication failed for user `%s`", username)
+	}
+	if _, err := session.Conn.Write([]byte{1, 0}); err != nil {
 		return err
 	}
 	return nil
@@ -113,7 +201,7 @@ func (session *ClientSession) close() {
 
 func (session *ClientSession) readRequest() (byte, string, error) {
 	head := make([]byte, 3)
-	if _, err := io.ReadFull(session.Conn, head); err != nil || head[0] != 5 || (head[1] != 1 && head[1] != 3) || head[2] != 0 {
+	if _, err := io.ReadFull(session.Conn, head); err != nil || head[0] != 5 || head[2] != 0 {
 		if err != nil {
 			return 0, "", err
 		}
@@ -122,43 +210,140 @@ func (session *ClientSession) readRequest() (byte, string, error) {
 
 	remoteAddress, err := readProxyAddress(session.Conn)
 	if err != nil {
+		if err == errUnsupportedAddressType {
+			session.rejectRequest(socks5ReplyAddressTypeNotSupported)
+		}
 		return 0, "", err
 	}
 	return head[1], remoteAddress, nil
 }
 
+// prepareRelayTCP dials `RemoteAddress` and replies with the address the remote connection is bound to.
 func (session *ClientSession) prepareRelayTCP(RuntimeContext context.Context, RemoteAddress string, Dialer func(network, address string) (net.Conn, error)) (net.Conn, error) {
 	conn, err := Dialer("tcp", RemoteAddress)
 	if err != nil {
-		return nil, fmt.Errorf("cannot handshake with proxy server: %v", err)
+		return nil, fmt.Errorf("cannot handshake with proxy server: %w", err)
 	}
-	writer := new(bytes.Buffer)
-	if _, err := writer.Write([]byte{5, 0, 0}); err != nil {
+	bindAddr := conn.LocalAddr()
+	if _, ok := bindAddr.(*net.TCPAddr); !ok {
+		// The dialer does not know the real address, replies with an unspecified one.
+		bindAddr = &net.TCPAddr{IP: net.IPv4zero, Port: 0}
+	}
+	if err := session.replySuccess(bindAddr); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	bindAddr, err := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	return conn, nil
+}
+
+// BindConn is the connection returned by the dialer for `bind` requests.
+type BindConn interface {
+	net.Conn
+	// BoundAddr returns the address the remote side is listening on.
+	BoundAddr() net.Addr
+	// AcceptPeer blocks until a peer connects to the bound address.
+	AcceptPeer() (net.Addr, error)
+}
+
+func (session *ClientSession) replySuccess(Addr net.Addr) error {
+	writer := new(bytes.Buffer)
+	if _, err := writer.Write([]byte{5, 0, 0}); err != nil {
+		return err
+	}
+	if err := writeIPAndPort(writer, Addr); err != nil {
+		return err
+	}
+	_, err := writer.WriteTo(session.Conn)
+	return err
+}
+
+// prepareRelayBind asks the remote side to listen for `RemoteAddress`, sends both replies of a bind request.
+func (session *ClientSession) prepareRelayBind(RemoteAddress string, Dialer func(network, address string) (net.Conn, error)) (net.Conn, error) {
+	conn, err := Dialer("bind", RemoteAddress)
 	if err != nil {
+		return nil, fmt.Errorf("cannot handshake with proxy server: %w", err)
+	}
+	bindConn, ok := conn.(BindConn)
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("dialer does not support bind")
+	}
+	if err := session.replySuccess(bindConn.BoundAddr()); err != nil {
 		conn.Close()
 		return nil, err
 	}
-	if err := writeIPAndPort(writer, bindAddr); err != nil {
+	peerAddr, err := bindConn.AcceptPeer()
+	if err != nil {
 		conn.Close()
 		return nil, err
 	}
-	if _, err := writer.WriteTo(session.Conn); err != nil {
+	if err := session.replySuccess(peerAddr); err != nil {
 		conn.Close()
 		return nil, err
 	}
 	return conn, nil
 }
 
-func (session *ClientSession) rejectRequest() {
-	session.Conn.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0})
+func (session *ClientSession) rejectRequest(code byte) {
+	session.Conn.Write([]byte{5, code, 0, 1, 0, 0, 0, 0, 0, 0})
+}
+
+// relayUDPFanIn relays the datagrams from `udpConn` through a tunnel per destination.
+func (session *ClientSession) relayUDPFanIn(serveContext context.Context, udpConn *net.UDPConn, Dialer func(network, address string) (net.Conn, error)) {
+	var localAddr *net.UDPAddr
+
+	channelPool := fan.NewChannelPool(serveContext, &fan.RedirectionConfig{Timeout: time.Second * 30, BufferSize: 65536})
+	fan.RedirectFanIn(serveContext, channelPool, func(buf []byte) (int, int, string, error) {
+		n, sender, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return -1, -1, "", err
+		}
+		reader := bytes.NewReader(buf)
+		for i := 0; i < 3; i++ {
+			if b, err := reader.ReadByte(); err != nil || b != 0 {
+				if err != nil {
+					return -1, -1, "", err
+				}
+				return -1, -1, "", fmt.Errorf("invalid request")
+			}
+		}
+		localAddr = sender
+		addr, err := readProxyAddress(reader)
+		if err != nil {
+			return -1, -1, "", err
+		}
+		return (len(buf) - reader.Len()), n, addr, nil
+	}, func(b []byte, s string) (int, error) {
+		writer := new(bytes.Buffer)
+		writer.Write([]byte{0, 0, 0})
+		udpAddr, err := net.ResolveUDPAddr("udp", s)
+		if err != nil {
+			return -1, err
+		}
+		if err := writeIPAndPort(writer, udpAddr); err != nil {
+			return -1, err
+		}
+		writer.Write(b)
+		total := writer.Len()
+		n, err := udpConn.WriteToUDP(writer.Bytes(), localAddr)
+		return len(b) - (total - n), err
+	}, func(s string) (net.Conn, error) {
+		peerConn, err := Dialer("udp", s)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			<-serveContext.Done()
+			peerConn.Close()
+		}()
+		return peerConn, nil
+	})
 }
 
 // StartProxyClient creates a local socks5 service, and forward traffic to proxy server on `Channel`.
-func StartProxyClient(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string) error {
+// If `Credentials` is not empty, clients are required to authenticate with username/password.
+// Connections are drained by `Tracker`.
+func StartProxyClient(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, Credentials *Socks5Credentials, Tracker *connectionTracker) error {
 	listener, err := net.Listen("tcp", LocalAddress)
 	if err != nil {
 		return err
@@ -167,24 +352,52 @@ func StartProxyClient(RuntimeContext context.Context, Dialer func(network, addre
 		<-RuntimeContext.Done()
 		listener.Close()
 	}()
-	return StartProxyClientWithListener(RuntimeContext, Dialer, LocalAddress, listener)
+	return StartProxyClientWithListener(RuntimeContext, Dialer, LocalAddress, listener, Credentials, Tracker)
 }
 
-// StartProxyClientWithListener starts a socks5 proxy on `listener`.
-func StartProxyClientWithListener(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, listener net.Listener) error {
+// StartProxyClientWithListener starts a proxy on `listener`.
+// The protocol is detected from the first byte of each connection: socks5, socks4/4a, otherwise HTTP.
+func StartProxyClientWithListener(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, listener net.Listener, Credentials *Socks5Credentials, Tracker *connectionTracker) error {
 	udpAddr, err := net.ResolveUDPAddr("udp", LocalAddress)
 	if err != nil {
 		return err
 	}
+	httpListener := newConnListener(listener.Addr())
+	defer httpListener.Close()
+	go StartHTTPProxyClientWithListener(RuntimeContext, Dialer, httpListener, Credentials, Tracker)
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
 
 	for RuntimeContext.Err() == nil {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		if !Tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
 		go func(conn net.Conn) {
-			session := ClientSession{Conn: conn}
+			// Connections handed to the HTTP proxy are tracked by the HTTP server instead.
+			defer Tracker.Untrack(conn)
+			clientconn := &bufferedConn{Conn: conn, reader: bufio.NewReader(conn)}
+			firstByte, err := clientconn.reader.Peek(1)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			if firstByte[0] != 4 && firstByte[0] != 5 {
+				if err := httpListener.Push(clientconn); err != nil {
+					conn.Close()
+				}
+				return
+			}
+			session := ClientSession{Conn: clientconn, Credentials: Credentials}
 			defer session.close()
+			if firstByte[0] == 4 {
+				session.serveSocks4(RuntimeContext, clientconn.reader, Dialer)
+				return
+			}
 
 			if err := session.socks5auth(); err != nil {
 				log.Printf("failed to handshake: %v", err)
@@ -201,7 +414,19 @@ func StartProxyClientWithListener(RuntimeContext context.Context, Dialer func(ne
 			case 1:
 				remoteConn, err := session.prepareRelayTCP(RuntimeContext, remoteAddress, Dialer)
 				if err != nil {
-					session.rejectRequest()
+					session.rejectRequest(socks5ReplyCode(err))
+					return
+				}
+				defer remoteConn.Close()
+				ctx, cancelFn := context.WithCancel(RuntimeContext)
+				go func() { io.Copy(session.Conn, remoteConn); cancelFn() }()
+				go func() { io.Copy(remoteConn, session.Conn); cancelFn() }()
+				<-ctx.Done()
+			case 2:
+				remoteConn, err := session.prepareRelayBind(remoteAddress, Dialer)
+				if err != nil {
+					log.Printf("bind request failed: %v", err)
+					session.rejectRequest(socks5ReplyCode(err))
 					return
 				}
 				defer remoteConn.Close()
@@ -216,9 +441,17 @@ func StartProxyClientWithListener(RuntimeContext context.Context, Dialer func(ne
 					Port: 0,
 				})
 				if err != nil {
-					session.rejectRequest()
+					session.rejectRequest(socks5ReplyGeneralFailure)
 					return
 				}
+				defer udpConn.Close()
+				// All destinations share one tunnel, endpoints of older versions require a tunnel per destination.
+				tunnel, err := Dialer("udp-mux", "0.0.0.0:0")
+				if err != nil {
+					log.Printf("UDP multiplexing is unavailable, fallback to per destination tunnels: %v", err)
+				} else {
+					defer tunnel.Close()
+				}
 				writer := new(bytes.Buffer)
 				if _, err := writer.Write([]byte{5, 0, 0}); err != nil {
 					return
@@ -233,53 +466,13 @@ func StartProxyClientWithListener(RuntimeContext context.Context, Dialer func(ne
 					udpConn.Close()
 					cancelFn()
 				}()
-				var localAddr *net.UDPAddr
-
-				channelPool := fan.NewChannelPool(serveContext, &fan.RedirectionConfig{Timeout: time.Second * 30, BufferSize: 65536})
-				fan.RedirectFanIn(serveContext, channelPool, func(buf []byte) (int, int, string, error) {
-					n, sender, err := udpConn.ReadFromUDP(buf)
-					if err != nil {
-						return -1, -1, "", err
-					}
-					reader := bytes.NewReader(buf)
-					for i := 0; i < 3; i++ {
-						if b, err := reader.ReadByte(); err != nil || b != 0 {
-							if err != nil {
-								return -1, -1, "", err
-							}
-							return -1, -1, "", fmt.Errorf("invalid request")
-						}
-					}
-					localAddr = sender
-					addr, err := readProxyAddress(reader)
-					if err != nil {
-						return -1, -1, "", err
-					}
-					return (len(buf) - reader.Len()), n, addr, nil
-				}, func(b []byte, s string) (int, error) {
-					writer := new(bytes.Buffer)
-					writer.Write([]byte{0, 0, 0})
-					udpAddr, err := net.ResolveUDPAddr("udp", s)
-					if err != nil {
-						return -1, err
-					}
-					if err := writeIPAndPort(writer, udpAddr); err != nil {
-						return -1, err
-					}
-					writer.Write(b)
-					total := writer.Len()
-					n, err := udpConn.WriteToUDP(writer.Bytes(), localAddr)
-					return len(b) - (total - n), err
-				}, func(s string) (net.Conn, error) {
-					peerConn, err := Dialer("udp", s)
-					go func() {
-						<-serveContext.Done()
-						peerConn.Close()
-					}()
-					return peerConn, err
-				})
+				if tunnel != nil {
+					relayUDPMux(udpConn, tunnel)
+					return
+				}
+				session.relayUDPFanIn(serveContext, udpConn, Dialer)
 			default:
-				session.rejectRequest()
+				session.rejectRequest(socks5ReplyCommandNotSupported)
 			}
 		}(conn)
 	}
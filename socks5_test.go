@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func runSocks5Auth(t *testing.T, credentials *Socks5Credentials, clientData []byte, expectedReply []byte) error {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	result := make(chan error, 1)
+	go func() {
+		session := ClientSession{Conn: serverConn, Credentials: credentials}
+		result <- session.socks5auth()
+		serverConn.Close()
+	}()
+	go clientConn.Write(clientData)
+	reply, _ := io.ReadAll(clientConn)
+	if !bytes.Equal(reply, expectedReply) {
+		t.Errorf("unexpected reply: %v, expect %v", reply, expectedReply)
+	}
+	return <-result
+}
+
+func TestSocks5AuthNoCredentials(t *testing.T) {
+	if err := runSocks5Auth(t, nil, []byte{5, 1, 0}, []byte{5, 0}); err != nil {
+		t.Error(err)
+	}
+	if err := runSocks5Auth(t, nil, []byte{5, 1, 2}, []byte{5, 0xff}); err == nil {
+		t.Error("expect an error if no acceptable method is offered")
+	}
+}
+
+func TestSocks5AuthUserPassword(t *testing.T) {
+	credentials := NewSocks5Credentials()
+	if err := credentials.AddList("alice:secret,bob:hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	credentials.SetDenyList([]string{"bob"})
+
+	authRequest := func(username, password string) []byte {
+		data := []byte{5, 2, 0, 2, 1, byte(len(username))}
+		data = append(data, username...)
+		data = append(data, byte(len(password)))
+		return append(data, password...)
+	}
+
+	if err := runSocks5Auth(t, credentials, authRequest("alice", "secret"), []byte{5, 2, 1, 0}); err != nil {
+		t.Error(err)
+	}
+	if err := runSocks5Auth(t, credentials, authRequest("alice", "wrong"), []byte{5, 2, 1, 1}); err == nil {
+		t.Error("expect an error on wrong password")
+	}
+	if err := runSocks5Auth(t, credentials, authRequest("bob", "hunter2"), []byte{5, 2, 1, 1}); err == nil {
+		t.Error("expect an error on denied user")
+	}
+	if err := runSocks5Auth(t, credentials, []byte{5, 1, 0}, []byte{5, 0xff}); err == nil {
+		t.Error("expect an error if client does not offer username/password")
+	}
+}
+
+func TestSocks5ReplyCode(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddress := listener.Addr().String()
+	listener.Close()
+
+	_, err = net.Dial("tcp", closedAddress)
+	if err == nil {
+		t.Fatal("expect dialing a closed port to fail")
+	}
+	resp := failureResponse(err)
+	if code := socks5ReplyCode(&remoteError{Class: resp.ErrorClass, Message: resp.Payload}); code != socks5ReplyConnectionRefused {
+		t.Errorf("expect connection refused, got %d", code)
+	}
+	if code := socks5ReplyCode(&remoteError{Class: errorClassDNSFailure}); code != socks5ReplyHostUnreachable {
+		t.Errorf("expect host unreachable, got %d", code)
+	}
+	if code := socks5ReplyCode(io.EOF); code != socks5ReplyGeneralFailure {
+		t.Errorf("expect general failure, got %d", code)
+	}
+}
+
+// readSocks5Reply reads a successful SOCKS5 reply from `conn`, returns BND.ADDR:BND.PORT.
+func readSocks5Reply(t *testing.T, conn net.Conn) string {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header, []byte{5, 0, 0}) {
+		t.Fatalf("unexpected reply header: %v", header)
+	}
+	address, err := readProxyAddress(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return address
+}
+
+func TestSocks5Bind(t *testing.T) {
+	proxyAddress := startProxyServer(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	defer listener.Close()
+	dialer := func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		return proxyHandshake(conn, network, address, false, false)
+	}
+	go StartProxyClientWithListener(ctx, dialer, listener.Addr().String(), listener, nil, newConnectionTracker())
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	conn.Write([]byte{5, 1, 0, 5, 2, 0, 1, 127, 0, 0, 1, 0, 0})
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	bindAddress := readSocks5Reply(t, conn)
+	if host, port, _ := net.SplitHostPort(bindAddress); host != "127.0.0.1" || port == "0" {
+		t.Fatalf("unexpected bound address %s", bindAddress)
+	}
+
+	peer, err := net.Dial("tcp", bindAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.SetDeadline(time.Now().Add(10 * time.Second))
+	if peerAddress := readSocks5Reply(t, conn); peerAddress != peer.LocalAddr().String() {
+		t.Errorf("unexpected peer address %s, expect %s", peerAddress, peer.LocalAddr())
+	}
+
+	for _, pair := range [][2]net.Conn{{conn, peer}, {peer, conn}} {
+		message := []byte("hello " + pair[0].LocalAddr().String())
+		if _, err := pair[0].Write(message); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(message))
+		if _, err := io.ReadFull(pair[1], buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf, message) {
+			t.Errorf("unexpected data: %s, expect %s", buf, message)
+		}
+	}
+}
+
+func TestMixedProtocolListener(t *testing.T) {
+	echoAddress := startEchoServer(t)
+	echoHost, echoPortString, _ := net.SplitHostPort(echoAddress)
+	echoPort, _ := strconv.Atoi(echoPortString)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelFn := context.WithCancel(context.Background())
+	defer cancelFn()
+	defer listener.Close()
+	// Records the endpoint-side local address of every relayed connection.
+	proxyAddress := startProxyServer(t)
+	localAddrs := make(chan net.Addr, 3)
+	dialer := func(network, address string) (net.Conn, error) {
+		conn, err := net.Dial("tcp", proxyAddress)
+		if err != nil {
+			return nil, err
+		}
+		remoteConn, err := proxyHandshake(conn, network, address, false, false)
+		if err == nil {
+			localAddrs <- remoteConn.LocalAddr()
+		}
+		return remoteConn, err
+	}
+	go StartProxyClientWithListener(ctx, dialer, listener.Addr().String(), listener, nil, newConnectionTracker())
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	expectReply := func(conn net.Conn, expected []byte) {
+		reply := make([]byte, len(expected))
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(reply, expected) {
+			t.Fatalf("unexpected reply: %v, expect %v", reply, expected)
+		}
+	}
+
+	// socks5
+	conn := dial()
+	request := []byte{5, 1, 0, 5, 1, 0, 1}
+	request = append(request, net.ParseIP(echoHost).To4()...)
+	request = append(request, byte(echoPort>>8), byte(echoPort))
+	conn.Write(request)
+	expectReply(conn, []byte{5, 0})
+	boundAddress := readSocks5Reply(t, conn)
+	if localAddr := <-localAddrs; boundAddress != localAddr.String() {
+		t.Errorf("unexpected bound address %s, expect %s", boundAddress, localAddr)
+	}
+	if host, port, _ := net.SplitHostPort(boundAddress); host != "127.0.0.1" || port == "0" {
+		t.Errorf("expect the endpoint-side local address, got %s", boundAddress)
+	}
+	expectEcho(t, conn)
+	conn.Close()
+
+	// socks4a
+	conn = dial()
+	request = []byte{4, 1, byte(echoPort >> 8), byte(echoPort), 0, 0, 0, 1, 'u', 0}
+	request = append(request, []byte("localhost\x00")...)
+	conn.Write(request)
+	expectReply(conn, []byte{0, socks4ReplyGranted, 0, 0, 0, 0, 0, 0})
+	expectEcho(t, conn)
+	conn.Close()
+
+	// http
+	conn = dial()
+	conn.Write([]byte("CONNECT " + echoAddress + " HTTP/1.1\r\nHost: " + echoAddress + "\r\n\r\n"))
+	expectReply(conn, []byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	expectEcho(t, conn)
+	conn.Close()
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Transparent proxies receive traffic redirected by iptables or nftables, and recover the original destinations.
+//
+//	redirect: `-j REDIRECT --to-ports [port]`, TCP only. Destinations are read with SO_ORIGINAL_DST.
+//	tproxy:   `-j TPROXY --on-port [port] --tproxy-mark [mark]` with a policy route delivering the mark locally.
+//	          Destinations are the local addresses of sockets, UDP is supported as well.
+
+var errTransparentUnsupported = errors.New("transparent proxy is only supported on linux")
+
+// transparentUDPQueueSize limits the datagrams queued for a destination while its tunnel is being dialed.
+const transparentUDPQueueSize = 64
+
+// transparentUDPSession relays datagrams between a client and one original destination.
+type transparentUDPSession struct {
+	tunnel net.Conn
+	// reply is bound to the original destination so that replies look like coming from it.
+	reply *net.UDPConn
+	// connected is false while the tunnel is being dialed, datagrams are queued in `pending` meanwhile.
+	connected bool
+	pending   [][]byte
+}
+
+// StartTransparentProxy accepts connections redirected to `LocalAddress` and connects them to their original
+// destinations through `Dialer`. If `TProxy` is true, UDP packets redirected to the same port are also forwarded,
+// each pair of source and destination has its own tunnel which is closed after being idle for `UDPTimeout`.
+// Connections and tunnels are drained by `Tracker`.
+func StartTransparentProxy(RuntimeContext context.Context, Dialer func(network, address string) (net.Conn, error), LocalAddress string, TProxy bool, UDPTimeout time.Duration, Tracker *connectionTracker) error {
+	listener, err := listenTransparentTCP(LocalAddress, TProxy)
+	if err != nil {
+		return err
+	}
+	serveContext, cancelFn := context.WithCancel(RuntimeContext)
+	defer cancelFn()
+	go func() {
+		<-serveContext.Done()
+		listener.Close()
+	}()
+	if TProxy {
+		udpConn, err := listenTransparentUDP(LocalAddress)
+		if err != nil {
+			return err
+		}
+		go func() {
+			<-serveContext.Done()
+			udpConn.Close()
+		}()
+		go func() {
+			if err := serveTransparentUDP(serveContext, Dialer, udpConn, UDPTimeout, Tracker); err != nil && serveContext.Err() == nil {
+				log.Printf("transparent proxy: udp service exited: %v", err)
+			}
+			cancelFn()
+		}()
+	}
+	listenAddr := listener.Addr().(*net.TCPAddr).AddrPort()
+	Tracker.TrackListener(listener)
+	defer Tracker.UntrackListener(listener)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if serveContext.Err() != nil {
+				return serveContext.Err()
+			}
+			return err
+		}
+		if !Tracker.Track(conn) {
+			conn.Close()
+			continue
+		}
+		go func(conn net.Conn) {
+			defer Tracker.Untrack(conn)
+			defer conn.Close()
+			destination := conn.LocalAddr().(*net.TCPAddr).AddrPort()
+			if !TProxy {
+				var err error
+				if destination, err = originalDestination(conn.(*net.TCPConn)); err != nil {
+					log.Printf("transparent proxy: cannot recover the destination of %s: %v", conn.RemoteAddr().String(), err)
+					return
+				}
+			}
+			// Connections not redirected by the firewall would reach the proxy again.
+			if destination.Port() == listenAddr.Port() && (destination.Addr().Unmap() == listenAddr.Addr().Unmap() || destination.Addr().IsLoopback()) {
+				log.Printf("transparent proxy: rejected %s connecting to the proxy itself", conn.RemoteAddr().String())
+				return
+			}
+			address := netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port()).String()
+			remoteConn, err := Dialer("tcp", address)
+			if err != nil {
+				log.Printf("transparent proxy: %s failed: %v", address, err)
+				return
+			}
+			defer remoteConn.Close()
+			ctx, cancelFn := context.WithCancel(serveContext)
+			go func() { io.Copy(conn, remoteConn); cancelFn() }()
+			go func() { io.Copy(remoteConn, conn); cancelFn() }()
+			<-ctx.Done()
+		}(conn)
+	}
+}
+
+// serveTransparentUDP forwards the datagrams received by `udpConn` to their original destinations.
+// Sessions are tracked by `tracker`, datagrams starting new sessions are dropped while draining. Tunnels are dialed
+// in the background, so that a slow destination does not hold the datagrams of the others.
+func serveTransparentUDP(ctx context.Context, Dialer func(network, address string) (net.Conn, error), udpConn *net.UDPConn, timeout time.Duration, tracker *connectionTracker) error {
+	var mu sync.Mutex
+	sessions := map[string]*transparentUDPSession{}
+	closed := false
+	closeSession := func(key string, session *transparentUDPSession) {
+		mu.Lock()
+		if sessions[key] == session {
+			delete(sessions, key)
+		}
+		mu.Unlock()
+		session.tunnel.Close()
+		session.reply.Close()
+	}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		// Sessions still connecting are closed by their dialing goroutines.
+		for _, session := range sessions {
+			if session.connected {
+				session.tunnel.Close()
+				session.reply.Close()
+			}
+		}
+	}()
+	// connect dials the tunnel of `session`, then writes the queued datagrams and starts relaying replies.
+	connect := func(key string, session *transparentUDPSession, source, destination netip.AddrPort) {
+		abort := func() {
+			mu.Lock()
+			if sessions[key] == session {
+				delete(sessions, key)
+			}
+			mu.Unlock()
+		}
+		tunnel, err := Dialer("udp", destination.String())
+		if err != nil {
+			log.Printf("transparent proxy: udp %s failed: %v", destination.String(), err)
+			abort()
+			return
+		}
+		trackedTunnel, ok := tracker.TrackConn(tunnel)
+		if !ok {
+			tunnel.Close()
+			abort()
+			return
+		}
+		reply, err := bindTransparentUDP(destination)
+		if err != nil {
+			log.Printf("transparent proxy: cannot reply as %s: %v", destination.String(), err)
+			trackedTunnel.Close()
+			abort()
+			return
+		}
+		session.tunnel, session.reply = trackedTunnel, reply
+		// Datagrams keep being queued while the queue is written, so that they are sent in order.
+		for {
+			mu.Lock()
+			if closed || sessions[key] != session {
+				mu.Unlock()
+				trackedTunnel.Close()
+				reply.Close()
+				return
+			}
+			pending := session.pending
+			session.pending = nil
+			session.connected = len(pending) == 0
+			mu.Unlock()
+			if len(pending) == 0 {
+				break
+			}
+			session.tunnel.SetReadDeadline(time.Now().Add(timeout))
+			for _, datagram := range pending {
+				if _, err := session.tunnel.Write(datagram); err != nil {
+					closeSession(key, session)
+					return
+				}
+			}
+		}
+		defer closeSession(key, session)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := session.tunnel.Read(buf)
+			if err != nil {
+				return
+			}
+			session.tunnel.SetReadDeadline(time.Now().Add(timeout))
+			if _, err := session.reply.WriteToUDPAddrPort(buf[:n], source); err != nil {
+				return
+			}
+		}
+	}
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, source, destination, err := readTransparentUDP(udpConn, buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		source = netip.AddrPortFrom(source.Addr().Unmap(), source.Port())
+		destination = netip.AddrPortFrom(destination.Addr().Unmap(), destination.Port())
+		key := fmt.Sprintf("%s|%s", source.String(), destination.String())
+		mu.Lock()
+		session := sessions[key]
+		if session == nil {
+			if tracker.Draining() {
+				mu.Unlock()
+				continue
+			}
+			session = &transparentUDPSession{}
+			sessions[key] = session
+			go connect(key, session, source, destination)
+		}
+		if !session.connected {
+			if len(session.pending) < transparentUDPQueueSize {
+				session.pending = append(session.pending, append([]byte{}, buf[:n]...))
+			}
+			mu.Unlock()
+			continue
+		}
+		mu.Unlock()
+		session.tunnel.SetReadDeadline(time.Now().Add(timeout))
+		if _, err := session.tunnel.Write(buf[:n]); err != nil {
+			closeSession(key, session)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options missing in package syscall, see linux/netfilter_ipv4.h and linux/in6.h.
+const (
+	soOriginalDst       = 80
+	ipv6Transparent     = 75
+	ipv6RecvOrigDstAddr = 74
+)
+
+// setTransparentOptions sets IP_TRANSPARENT on the socket, and asks for original destinations of UDP packets if `recvOrigDst` is true.
+func setTransparentOptions(network string, c syscall.RawConn, recvOrigDst bool) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		isIPv6 := network[len(network)-1] == '6'
+		if isIPv6 {
+			if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1); sockErr != nil {
+				return
+			}
+			if recvOrigDst {
+				if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1); sockErr != nil {
+					return
+				}
+			}
+		}
+		// Dual stack sockets also need the IPv4 options to receive IPv4 traffic, which might fail on old kernels.
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1); err != nil && !isIPv6 {
+			sockErr = err
+			return
+		}
+		if recvOrigDst {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1); err != nil && !isIPv6 {
+				sockErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("cannot set transparent socket options, CAP_NET_ADMIN is required: %v", sockErr)
+	}
+	return nil
+}
+
+// listenTransparentTCP listens on `address`, accepting connections to non-local addresses if `tproxy` is true.
+func listenTransparentTCP(address string, tproxy bool) (net.Listener, error) {
+	listenConfig := net.ListenConfig{}
+	if tproxy {
+		listenConfig.Control = func(network, address string, c syscall.RawConn) error {
+			return setTransparentOptions(network, c, false)
+		}
+	}
+	return listenConfig.Listen(context.Background(), "tcp", address)
+}
+
+// listenTransparentUDP listens on `address` for UDP packets redirected by TPROXY.
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparentOptions(network, c, true)
+		},
+	}
+	conn, err := listenConfig.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// bindTransparentUDP binds a socket to `address`, which is usually not local, to send packets from it.
+func bindTransparentUDP(address netip.AddrPort) (*net.UDPConn, error) {
+	network := "udp4"
+	if address.Addr().Is6() {
+		network = "udp6"
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(network, _ string, c syscall.RawConn) error {
+			var sockErr error
+			if err := c.Control(func(fd uintptr) {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}); err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return sockErr
+			}
+			return setTransparentOptions(network, c, false)
+		},
+	}
+	conn, err := listenConfig.ListenPacket(context.Background(), network, address.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// parseSockaddr parses a raw sockaddr_in or sockaddr_in6.
+func parseSockaddr(data []byte) (netip.AddrPort, error) {
+	if len(data) < 2 {
+		return netip.AddrPort{}, fmt.Errorf("sockaddr too short")
+	}
+	family := *(*uint16)(unsafe.Pointer(&data[0]))
+	switch {
+	case family == syscall.AF_INET && len(data) >= syscall.SizeofSockaddrInet4:
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(data[4:8])), binary.BigEndian.Uint16(data[2:4])), nil
+	case family == syscall.AF_INET6 && len(data) >= syscall.SizeofSockaddrInet6:
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(data[8:24])), binary.BigEndian.Uint16(data[2:4])), nil
+	}
+	return netip.AddrPort{}, fmt.Errorf("unsupported sockaddr family %d", family)
+}
+
+// originalDestination returns the destination of `conn` before it was redirected by REDIRECT.
+func originalDestination(conn *net.TCPConn) (netip.AddrPort, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	var destination netip.AddrPort
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		// IPv4 connections on dual stack sockets are tracked as IPv4 as well, so tries IPv4 first.
+		if mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst); err == nil {
+			destination, sockErr = parseSockaddr(mreq.Multiaddr[:])
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		destination, sockErr = parseSockaddr((*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))[:])
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return destination, sockErr
+}
+
+// readTransparentUDP reads a datagram, returns its source and its original destination.
+func readTransparentUDP(conn *net.UDPConn, buf []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	oob := make([]byte, 128)
+	n, oobn, _, source, err := conn.ReadMsgUDPAddrPort(buf, oob)
+	if err != nil {
+		return n, source, netip.AddrPort{}, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return n, source, netip.AddrPort{}, err
+	}
+	for _, message := range messages {
+		if (message.Header.Level == syscall.SOL_IP && message.Header.Type == syscall.IP_ORIGDSTADDR) ||
+			(message.Header.Level == syscall.SOL_IPV6 && message.Header.Type == ipv6RecvOrigDstAddr) {
+			destination, err := parseSockaddr(message.Data)
+			return n, source, destination, err
+		}
+	}
+	return n, source, netip.AddrPort{}, fmt.Errorf("no original destination in the packet from %s", source.String())
+}
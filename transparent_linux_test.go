@@ -0,0 +1,68 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+func TestParseSockaddr(t *testing.T) {
+	for _, expected := range []netip.AddrPort{netip.MustParseAddrPort("10.1.2.3:443"), netip.MustParseAddrPort("[fd00::1]:53")} {
+		var data []byte
+		if expected.Addr().Is4() {
+			data = make([]byte, syscall.SizeofSockaddrInet4)
+			*(*uint16)(unsafe.Pointer(&data[0])) = syscall.AF_INET
+			copy(data[4:], expected.Addr().AsSlice())
+		} else {
+			data = make([]byte, syscall.SizeofSockaddrInet6)
+			*(*uint16)(unsafe.Pointer(&data[0])) = syscall.AF_INET6
+			copy(data[8:], expected.Addr().AsSlice())
+		}
+		binary.BigEndian.PutUint16(data[2:], expected.Port())
+		addrPort, err := parseSockaddr(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrPort != expected {
+			t.Errorf("got %v, expect %v", addrPort, expected)
+		}
+	}
+	if _, err := parseSockaddr([]byte{1}); err == nil {
+		t.Error("expect an error on truncated sockaddr")
+	}
+}
+
+func TestReadTransparentUDP(t *testing.T) {
+	udpConn, err := listenTransparentUDP("127.0.0.1:0")
+	if err != nil {
+		t.Skipf("transparent sockets are not available: %v", err)
+	}
+	defer udpConn.Close()
+	client, err := net.Dial("udp", udpConn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("ping"))
+
+	buf := make([]byte, maxDatagramSize)
+	n, source, destination, err := readTransparentUDP(udpConn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "ping" {
+		t.Errorf("unexpected payload: %s", buf[:n])
+	}
+	if source.String() != client.LocalAddr().String() {
+		t.Errorf("unexpected source %v, expect %v", source, client.LocalAddr())
+	}
+	// Without TPROXY rules, the original destination is the socket itself.
+	if destination.String() != udpConn.LocalAddr().String() {
+		t.Errorf("unexpected destination %v, expect %v", destination, udpConn.LocalAddr())
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"net/netip"
+)
+
+func listenTransparentTCP(address string, tproxy bool) (net.Listener, error) {
+	return nil, errTransparentUnsupported
+}
+
+func listenTransparentUDP(address string) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func bindTransparentUDP(address netip.AddrPort) (*net.UDPConn, error) {
+	return nil, errTransparentUnsupported
+}
+
+func originalDestination(conn *net.TCPConn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errTransparentUnsupported
+}
+
+func readTransparentUDP(conn *net.UDPConn, buf []byte) (int, netip.AddrPort, netip.AddrPort, error) {
+	return 0, netip.AddrPort{}, netip.AddrPort{}, errTransparentUnsupported
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// A `udp-mux` tunnel carries the datagrams of a whole UDP association.
+// Each framed datagram starts with the socks5 style address of the destination (client to endpoint)
+// or of the source (endpoint to client), followed by the payload.
+
+// maxResolvedAddresses limits the size of the per-association name and denial caches on the endpoint.
+const maxResolvedAddresses = 256
+
+// relayUDPMux relays socks5 UDP requests received on `udpConn` through `tunnel` until `udpConn` is closed.
+func relayUDPMux(udpConn *net.UDPConn, tunnel net.Conn) {
+	mu := sync.Mutex{}
+	var clientAddr *net.UDPAddr
+
+	go func() {
+		defer udpConn.Close()
+		buf := make([]byte, maxDatagramSize+3)
+		for {
+			n, err := tunnel.Read(buf[3:])
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			addr := clientAddr
+			mu.Unlock()
+			if addr == nil {
+				continue
+			}
+			buf[0], buf[1], buf[2] = 0, 0, 0
+			if _, err := udpConn.WriteToUDP(buf[:n+3], addr); err != nil {
+				log.Printf("udp-mux: cannot write to client: %v", err)
+			}
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, sender, err := udpConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		// Fragmentation is not supported, such datagrams are dropped as RFC 1928 allows.
+		if n < 4 || buf[0] != 0 || buf[1] != 0 || buf[2] != 0 {
+			continue
+		}
+		mu.Lock()
+		clientAddr = sender
+		mu.Unlock()
+		if _, err := tunnel.Write(buf[3:n]); err != nil {
+			log.Printf("udp-mux: cannot write to tunnel: %v", err)
+			return
+		}
+	}
+}
+
+// resolveRemoteUDP resolves the destination of a datagram from `peer`, only returning addresses allowed by `endpointACL`.
+func resolveRemoteUDP(peer, address string) (*net.UDPAddr, error) {
+	ctx, cancelFn := context.WithTimeout(context.Background(), *socks5DialTimeout)
+	defer cancelFn()
+	addresses, err := endpointACL.Resolve(ctx, peer, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", addresses[0])
+}
+
+// serveUDPMux forwards the datagrams from `clientconn` to their destinations through a single UDP socket.
+func serveUDPMux(clientconn net.Conn, peer string, reply func(response) error) {
+	udpConn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		reply(failureResponse(err))
+		return
+	}
+	defer udpConn.Close()
+	if reply(response{Success: true, Payload: udpConn.LocalAddr().String(), Framed: true}) != nil {
+		return
+	}
+	tunnel := newDatagramConn(clientconn)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	go func() {
+		defer cancelFn()
+		buf := make([]byte, maxDatagramSize)
+		writer := new(bytes.Buffer)
+		for {
+			n, sender, err := udpConn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			writer.Reset()
+			if err := writeIPAndPort(writer, sender); err != nil {
+				continue
+			}
+			writer.Write(buf[:n])
+			// The address header might not fit along with a large datagram, only that datagram is dropped.
+			if writer.Len() > maxDatagramSize {
+				log.Printf("udp-mux: dropping a datagram of %d bytes from %s, too large to frame", n, sender)
+				continue
+			}
+			if _, err := tunnel.Write(writer.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		defer cancelFn()
+		resolved := map[string]*net.UDPAddr{}
+		// Denied destinations stay denied for the whole association, so that they are checked and logged once.
+		denied := map[string]bool{}
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := tunnel.Read(buf)
+			if err != nil {
+				return
+			}
+			reader := bytes.NewReader(buf[:n])
+			address, err := readProxyAddress(reader)
+			if err != nil {
+				continue
+			}
+			if denied[address] {
+				continue
+			}
+			target, exist := resolved[address]
+			if !exist {
+				if target, err = resolveRemoteUDP(peer, address); err != nil {
+					// Other errors like DNS failures may be temporary, they are retried by the next datagram.
+					if errors.Is(err, errAccessDenied) && len(denied) < maxResolvedAddresses {
+						denied[address] = true
+					}
+					log.Printf("udp-mux: cannot resolve %s: %v", address, err)
+					continue
+				}
+				if len(resolved) >= maxResolvedAddresses {
+					resolved = map[string]*net.UDPAddr{}
+				}
+				resolved[address] = target
+			}
+			udpConn.WriteToUDP(buf[n-reader.Len():n], target)
+		}
+	}()
+	<-ctx.Done()
+}